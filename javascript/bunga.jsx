@@ -170,6 +170,14 @@ const Bunga = (props) => {
   const appRef = useRef(null)
   const cardTexturesRef = useRef(null)
   const [resourcesLoaded, setResourcesLoaded] = useState(false)
+  const [timeLeft, setTimeLeft] = useState(0)
+
+  // count down the turn clock between views
+  useEffect(() => {
+    setTimeLeft(props.gameState != null ? props.gameState.TimeLeft : 0)
+    const timer = setInterval(() => setTimeLeft((t) => Math.max(0, t - 1)), 1000)
+    return () => clearInterval(timer)
+  }, [props.gameState])
   const actionRef = useRef(0)
   const animRef = useRef({})
 
@@ -181,6 +189,8 @@ const Bunga = (props) => {
     cardNums.forEach((name) => {
       suits.forEach((suit) => cards.push(name + suit))
     })
+    cards.push('1J')
+    cards.push('2J')
     cards.push('1B')
     cards.push('2B')
     cards.push('X')
@@ -268,7 +278,11 @@ const Bunga = (props) => {
       g.endFill()
       c.addChild(g)
       const nameStyle = { fontFamily: 'Arial', fontSize: 16, fill: 0xffffff }
-      let nameText = new PIXI.Text(player, nameStyle)
+      let name = player
+      if (props.lobbyState.Away != null && props.lobbyState.Away[player] != null) {
+        name += " (away)"
+      }
+      let nameText = new PIXI.Text(name, nameStyle)
       nameText.anchor.set(0.5, 0)
       nameText.x = screenWidth / 2
       nameText.y = cardHeight + 15
@@ -336,8 +350,19 @@ const Bunga = (props) => {
       const [player, hand] = entry
       // console.log('drawing hand for', player, 'hand: ', hand)
       let handPositions = getHandPositions(screenWidth, hand.length)
+      let remembered = props.gameState.Remembered != null ? props.gameState.Remembered[player] : null
       hand.forEach((card, idx) => {
         let handCard = getCardSprite(cardTexturesRef, card)
+        // with assisted memory, a card the player has seen shows small in the corner of its back
+        if (remembered != null && remembered[idx]) {
+          let reminder = new PIXI.Sprite(cardTexturesRef.current[remembered[idx]])
+          reminder.width = cardWidth / 2
+          reminder.height = cardHeight / 2
+          reminder.x = cardWidth / 2
+          reminder.y = cardHeight / 2
+          reminder.alpha = 0.8
+          handCard.addChild(reminder)
+        }
         handCard.on('pointerdown', () => {
           // console.log('sending cmd card', props.user, idx)
           sendCommand(props.ws, 'game', 'card', {
@@ -422,6 +447,11 @@ const Bunga = (props) => {
 
   return (
     <>
+      {timeLeft > 0 &&
+        <div className="tag is-warning">
+          {props.gameState.Turn == "" ? "Get ready" : props.gameState.Turn == props.user ? "Your turn" : props.gameState.Turn + "'s turn"}: {timeLeft}s
+        </div>
+      }
       <div className="level restheight">
         <div id="pixiRoot" className="level-item fullheight"></div>
       </div>
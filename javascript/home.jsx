@@ -2,16 +2,21 @@ import React, { useState } from 'react'
 import { useNavigate } from 'react-router-dom'
 
 import Nav from "./nav"
+import { sessionKey } from "./utils"
 
 const Home = () => {
   const [formName, setFormName] = useState("")
   const [formLobby, setFormLobby] = useState("")
   const [formError, setFormError] = useState("")
+  const [formFull, setFormFull] = useState(false)
+  const [formTaken, setFormTaken] = useState(false)
+  const [formMaxPlayers, setFormMaxPlayers] = useState("")
   const navigate = useNavigate()
 
   const checkValid = async (e) => {
     e.preventDefault()
     let lobbyCode = ""
+    let team = ""
     if (formLobby != "") {
       const resp = await fetch("/valid", {
         method: "POST",
@@ -24,6 +29,21 @@ const Home = () => {
         setFormError("on")
         return
       }
+      const valid = await resp.json()
+      // a taken name can only be rejoined from the tab that holds its session
+      const rejoining = valid.nameTaken && sessionStorage.getItem(sessionKey(formLobby, formName)) != null
+      if (valid.nameTaken && !rejoining) {
+        setFormTaken(true)
+        return
+      }
+      if (valid.full && !formFull && !rejoining) {
+        // Warn first, joining again goes in as a spectator
+        setFormFull(true)
+        return
+      }
+      if (valid.full) {
+        team = "Spectators"
+      }
       lobbyCode = formLobby
     } else {
       const resp = await fetch("/newLobby").then(response => response.json())
@@ -33,7 +53,12 @@ const Home = () => {
         throw "Error getting new lobby name"
       }
     }
-    navigate("/" + lobbyCode, { state: {"user": formName, "lobby": lobbyCode }})
+    navigate("/" + lobbyCode, { state: {
+      "user": formName,
+      "lobby": lobbyCode,
+      "team": team,
+      "maxPlayers": formLobby == "" ? formMaxPlayers : "",
+    }})
   }
 
   return (
@@ -57,6 +82,7 @@ const Home = () => {
                     onChange={e => {
                       setFormName(e.target.value)
                       setFormError("")
+                      setFormTaken(false)
                     }}
                   ></input>
                 </div>
@@ -72,19 +98,42 @@ const Home = () => {
                     onChange={e => {
                       setFormLobby(e.target.value)
                       setFormError("")
+                      setFormFull(false)
+                      setFormTaken(false)
                     }}
                   ></input>
                 </div>
               </div>
+              { formLobby == "" &&
+                <div className="field">
+                  <label className="label">Max players</label>
+                  <div className="control">
+                    <input
+                      className="input"
+                      name="maxPlayers"
+                      type="number"
+                      min="1"
+                      placeholder="default"
+                      onChange={e => setFormMaxPlayers(e.target.value)}
+                    ></input>
+                  </div>
+                </div>
+              }
               { formError != "" &&
                 <div className="notification is-danger">Invalid lobby or username</div>
               }
+              { formTaken &&
+                <div className="notification is-danger">Someone in this lobby already has that name</div>
+              }
+              { formFull &&
+                <div className="notification is-warning">This lobby is full, you can join as a spectator</div>
+              }
               <div className="field">
                 <div className="control">
                   { formLobby == "" &&
                     <button className="button is-success" type="submit">Create lobby</button>
                     ||
-                    <button className="button is-link" type="submit">Join lobby</button>
+                    <button className="button is-link" type="submit">{formFull ? "Join as spectator" : "Join lobby"}</button>
                   }
                 </div>
               </div>
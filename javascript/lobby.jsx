@@ -1,10 +1,11 @@
 import React, { useState, useEffect, useRef } from 'react'
 import { useLocation } from 'react-router-dom'
 
-import { sendCommand } from './utils'
+import { sendCommand, sessionKey, protocolVersion, mergePatch } from './utils'
 import Nav from "./nav"
 import LobbyInfo from "./lobbyInfo"
 import Bunga from "./bunga"
+import MatchInfo from "./match"
 
 const Lobby = () => {
   let location = useLocation()
@@ -19,36 +20,142 @@ const Lobby = () => {
   })
 
   const [gameState, setGameState] = useState(null)
+  const [error, setError] = useState(null)
+  const [notice, setNotice] = useState(null)
   const wsRef = useRef(null)
+  const errorTimer = useRef(null)
 
   const handleQuit = (quitWsRef) => {
     sendCommand(quitWsRef.current, 'lobby', 'backToLobby')
   }
 
-  // Create a websocket on component mount
+  // Create a websocket on component mount, and reconnect with the session token if it drops
   // don't cleanup until component is unmounted
   useEffect(() => {
-    // create socket
-    const host = window.location.host
-    const wsUri = encodeURI(`wss://${host}/joinLobby?user=${user}&lobby=${lobby}`)
-    wsRef.current = new WebSocket(wsUri)
-    wsRef.current.onopen = () => {
-      // console.log('Connected!')
+    let unmounted = false
+    let retries = 0
+    let retryTimer = null
+    // the number of the last message we got, and the last lobby and game views and the numbers they came with
+    // for applying patches to. These carry on across reconnects, so we can resume where we left off
+    let lastSeq = 0
+    let views = {}
+    let bases = {}
+    let fresh = true
+    let resuming = false
+    let resyncing = false
+
+    const connect = () => {
+      fresh = true
+      resuming = false
+      resyncing = false
+      // create socket
+      const host = window.location.host
+      let wsUri = encodeURI(`wss://${host}/joinLobby?user=${user}&lobby=${lobby}`)
+      if (location.state.team) {
+        wsUri += "&team=" + encodeURIComponent(location.state.team)
+      }
+      if (location.state.maxPlayers) {
+        wsUri += "&maxPlayers=" + encodeURIComponent(location.state.maxPlayers)
+      }
+      const token = sessionStorage.getItem(sessionKey(lobby, user))
+      if (token) {
+        wsUri += "&token=" + encodeURIComponent(token)
+      }
+      wsRef.current = new WebSocket(wsUri)
+      wsRef.current.onopen = () => {
+        // console.log('Connected!')
+        retries = 0
+        setNotice(null)
+        sendCommand(wsRef.current, 'hello', '', { 'version': String(protocolVersion), 'client': 'web', 'patches': 'true' })
+      }
+      wsRef.current.onmessage = handleMessage
+      wsRef.current.onclose = (event) => {
+        // the server keeps our seat for a while, so keep trying to get back in
+        // unless it closed the connection on purpose, e.g. we were kicked
+        if (!unmounted && event.code != 1000 && retries < 30) {
+          retries++
+          retryTimer = setTimeout(connect, 2000)
+        }
+      }
     }
-    wsRef.current.onmessage = (event) => {
+
+    const handleMessage = (event) => {
       let msg = JSON.parse(event.data)
       let newState = msg.State
+      // a new connection that starts numbering again means the server lost our seat, so start over
+      if (fresh && msg.Seq <= lastSeq) {
+        lastSeq = 0
+        views = {}
+        bases = {}
+      }
+      fresh = false
+      // we've already got anything that's being resent
+      if (msg.Seq <= lastSeq) {
+        return
+      }
+      // we missed too much to get it resent, fresh views come next
+      if (msg.Target == 'resume' && msg.State.Reset) {
+        lastSeq = msg.Seq - 1
+        views = {}
+        bases = {}
+      }
+      // we missed something, ask for everything since the last message we got
+      if (msg.Seq > lastSeq + 1) {
+        if (!resuming) {
+          resuming = true
+          sendCommand(wsRef.current, 'lobby', 'resume', { 'seq': String(lastSeq) })
+        }
+        return
+      }
+      lastSeq = msg.Seq
+      if (msg.Target == 'resume') {
+        resuming = false
+        return
+      }
+      if (msg.Patch !== undefined) {
+        // a patch against a view we don't have means we missed something, so ask for everything again
+        if (bases[msg.Target] != msg.Base) {
+          if (!resyncing) {
+            resyncing = true
+            sendCommand(wsRef.current, 'lobby', 'resync')
+          }
+          return
+        }
+        newState = mergePatch(views[msg.Target], msg.Patch)
+      } else if (msg.Target == 'lobby') {
+        resyncing = false
+      }
+      views[msg.Target] = newState
+      bases[msg.Target] = msg.Seq
       if (msg.Target == 'lobby') {
         // console.log('new lobby state:', newState)
         setLobbyState(newState)
-        setGameState(null)
+        // keep showing the last game's final hands between rounds of a match
+        if (newState.Status != "game") {
+          setGameState(null)
+        }
       } else if (msg.Target == 'game') {
         // console.log('new game state:', newState)
         setGameState(newState)
+      } else if (msg.Target == 'session') {
+        sessionStorage.setItem(sessionKey(lobby, user), newState)
+      } else if (msg.Target == 'error') {
+        // show the rejection for a few seconds
+        setError(newState.Message)
+        clearTimeout(errorTimer.current)
+        errorTimer.current = setTimeout(() => setError(null), 3000)
+      } else if (msg.Target == 'notice') {
+        // keep server notices up until they're dismissed or we reconnect
+        setNotice(newState)
       }
     }
 
+    connect()
+
     return () => {
+      unmounted = true
+      clearTimeout(retryTimer)
+      clearTimeout(errorTimer.current)
       wsRef.current.close()
     }
   }, [])
@@ -56,9 +163,24 @@ const Lobby = () => {
   return (
     <>
       <Nav lobbyState={lobbyState.Status} handleQuit={() => handleQuit(wsRef)}/>
+      {error &&
+        <div className="notification is-danger">
+          <button className="delete" onClick={() => setError(null)}></button>
+          {error}
+        </div>
+      }
+      {notice &&
+        <div className="notification is-warning">
+          <button className="delete" onClick={() => setNotice(null)}></button>
+          {notice}
+        </div>
+      }
       {lobbyState.Status == "lobby" &&
         <LobbyInfo user={user} lobby={lobby} lobbyState={lobbyState} ws={wsRef.current} />
       }
+      {lobbyState.Status == "game" && lobbyState.Match != null && lobbyState.Match.NextRound > 0 &&
+        <MatchInfo match={lobbyState.Match} isHost={lobbyState.Host == user} ws={wsRef.current} />
+      }
       {lobbyState.Status == "game" &&
         <Bunga user={user} lobbyState={lobbyState} gameState={gameState} ws={wsRef.current} />
       }
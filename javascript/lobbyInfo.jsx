@@ -1,10 +1,79 @@
-import React from 'react'
+import React, { useState } from 'react'
 
 import { sendCommand } from "./utils"
+import MatchInfo from "./match"
 
 const LobbyInfo = (props) => {
+  const [matchRounds, setMatchRounds] = useState("")
+  const [matchTarget, setMatchTarget] = useState("")
+  const [houseRules, setHouseRules] = useState({})
+
   const handleStartGame = () => {
-    sendCommand(props.ws, "lobby", "startGame")
+    let args = {}
+    if (matchRounds != "") {
+      args["rounds"] = matchRounds
+    }
+    if (matchTarget != "") {
+      args["target"] = matchTarget
+    }
+    Object.keys(houseRules).forEach((name) => {
+      if (houseRules[name] != "") {
+        args[name] = houseRules[name]
+      }
+    })
+    sendCommand(props.ws, "lobby", "startGame", args)
+  }
+
+  const handleAddBot = (level) => {
+    sendCommand(props.ws, "lobby", "addBot", { "level": level })
+  }
+
+  const spectating = props.lobbyState.Spectators != null && props.lobbyState.Spectators.includes(props.user)
+
+  const handleChangeTeam = () => {
+    sendCommand(props.ws, "lobby", "changeTeam", { "team": spectating ? "Players" : "Spectators" })
+  }
+
+  const isHost = props.lobbyState.Host == props.user
+
+  // the options the lobby's game takes, shown to the host as house rules
+  const gameOptions = () => {
+    const games = props.lobbyState.Games || []
+    const game = games.find((info) => info.Name == props.lobbyState.Game)
+    return game != null ? game.Options : []
+  }
+
+  const away = (id) => {
+    return props.lobbyState.Away != null && props.lobbyState.Away[id] != null
+  }
+
+  // how long the server's pings to someone take, if they're connected
+  const latency = (id) => {
+    if (props.lobbyState.Latency == null || props.lobbyState.Latency[id] == null) {
+      return ""
+    }
+    return ` (${props.lobbyState.Latency[id]} ms)`
+  }
+
+  // Host controls shown next to everyone else in the lobby
+  const hostControls = (id) => {
+    if (!isHost || id == props.user) {
+      return null
+    }
+    return (
+      <div className="field is-grouped">
+        <div className="control">
+          <button className="button is-small" onClick={() => sendCommand(props.ws, "lobby", "changeHost", { "player": id })}>
+            Make host
+          </button>
+        </div>
+        <div className="control">
+          <button className="button is-small is-danger" onClick={() => sendCommand(props.ws, "lobby", "kick", { "player": id })}>
+            Kick
+          </button>
+        </div>
+      </div>
+    )
   }
 
   return (
@@ -15,7 +84,59 @@ const LobbyInfo = (props) => {
       <div className="card-content">
         <div className="field">
           <div className="control">
-            <button className="button is-success" onClick={handleStartGame}>Start Game</button>
+            { isHost &&
+              <button className="button is-success" onClick={handleStartGame}>Start Game</button>
+              ||
+              <button className="button is-static">Waiting for {props.lobbyState.Host} to start</button>
+            }
+          </div>
+        </div>
+        { isHost &&
+          <div className="field is-grouped">
+            <div className="control">
+              <input className="input is-small" type="number" min="1" placeholder="Match rounds"
+                onChange={e => setMatchRounds(e.target.value)}></input>
+            </div>
+            <div className="control">
+              <input className="input is-small" type="number" min="1" placeholder="Match target score"
+                onChange={e => setMatchTarget(e.target.value)}></input>
+            </div>
+          </div>
+        }
+        { isHost &&
+          <details className="field">
+            <summary>House rules</summary>
+            {
+              gameOptions().map((option) => {
+                return (
+                  <div key={option.Name} className="field is-horizontal">
+                    <div className="field-label is-small">
+                      <label className="label" title={option.Description}>{option.Name}</label>
+                    </div>
+                    <div className="field-body">
+                      <input className="input is-small" type="text" placeholder={option.Default} title={option.Description}
+                        onChange={e => setHouseRules({ ...houseRules, [option.Name]: e.target.value })}></input>
+                    </div>
+                  </div>
+                )
+              })
+            }
+          </details>
+        }
+        { props.lobbyState.Match != null &&
+          <MatchInfo match={props.lobbyState.Match} isHost={isHost} ws={props.ws} />
+        }
+        <div className="field is-grouped">
+          <div className="control">
+            <button className="button is-small" onClick={() => handleAddBot("random")}>Add easy bot</button>
+          </div>
+          <div className="control">
+            <button className="button is-small" onClick={() => handleAddBot("memory")}>Add hard bot</button>
+          </div>
+          <div className="control">
+            <button className="button is-small" onClick={handleChangeTeam}>
+              {spectating ? "Join players" : "Spectate"}
+            </button>
           </div>
         </div>
         <div className="content">
@@ -27,7 +148,8 @@ const LobbyInfo = (props) => {
               props.lobbyState.Players.map((player) => {
                 return (
                   <div key={player} className="panel-block">
-                    <div className="control">{player}</div>
+                    <div className="control">{player}{player == props.lobbyState.Host && " (host)"}{away(player) && " (away)"}{latency(player)}</div>
+                    {hostControls(player)}
                     <div className="field">
                       <div className="control">
                         <div className="button is-static is-small">
@@ -40,6 +162,23 @@ const LobbyInfo = (props) => {
               })
             }
           </nav>
+          { props.lobbyState.Spectators != null && props.lobbyState.Spectators.length > 0 &&
+            <nav className="panel">
+              <div className="panel-heading">
+                <p>Spectators</p>
+              </div>
+              {
+                props.lobbyState.Spectators.map((spectator) => {
+                  return (
+                    <div key={spectator} className="panel-block">
+                      <div className="control">{spectator}{spectator == props.lobbyState.Host && " (host)"}{away(spectator) && " (away)"}{latency(spectator)}</div>
+                      {hostControls(spectator)}
+                    </div>
+                  )
+                })
+              }
+            </nav>
+          }
         </div>
       </div>
     </div>
@@ -0,0 +1,70 @@
+import React, { useState, useEffect } from 'react'
+
+import { sendCommand } from "./utils"
+
+// Round by round scores for the match being played, with a countdown to the next deal
+const MatchInfo = (props) => {
+  const match = props.match
+  const [now, setNow] = useState(Date.now() / 1000)
+
+  useEffect(() => {
+    if (match.NextRound == 0) {
+      return
+    }
+    const timer = setInterval(() => setNow(Date.now() / 1000), 1000)
+    return () => clearInterval(timer)
+  }, [match.NextRound])
+
+  let goal = ""
+  if (match.Rounds > 0) {
+    goal = `${match.Rounds} rounds`
+  }
+  if (match.Target > 0) {
+    goal += (goal != "" ? ", or " : "") + `until someone reaches ${match.Target}`
+  }
+
+  return (
+    <div className="box">
+      <p className="heading">Match: {goal}</p>
+      <table className="table is-narrow is-fullwidth">
+        <thead>
+          <tr>
+            <th>Player</th>
+            {match.Results.map((_, i) => <th key={i}>Round {i + 1}</th>)}
+            <th>Total</th>
+          </tr>
+        </thead>
+        <tbody>
+          {match.Players.map((player) => {
+            return (
+              <tr key={player} className={player == match.Winner ? "is-selected" : ""}>
+                <td>{player}</td>
+                {match.Results.map((round, i) => <td key={i}>{round[player]}</td>)}
+                <td>{match.Totals[player]}</td>
+              </tr>
+            )
+          })}
+        </tbody>
+      </table>
+      { match.Over &&
+        <p>{match.Winner} wins the match!</p>
+      }
+      { match.NextRound > 0 &&
+        <div className="field is-grouped">
+          <div className="control">
+            <p>Next round in {Math.max(0, Math.ceil(match.NextRound - now))}s</p>
+          </div>
+          { props.isHost &&
+            <div className="control">
+              <button className="button is-small is-success" onClick={() => sendCommand(props.ws, "lobby", "nextRound")}>
+                Deal now
+              </button>
+            </div>
+          }
+        </div>
+      }
+    </div>
+  )
+}
+
+export default MatchInfo
@@ -2,6 +2,9 @@ export const lerp = (a, b, t) => {
   return (1-t)*a + t*b;
 }
 
+// The websocket protocol version this client speaks, sent in a hello when connecting
+export const protocolVersion = 1
+
 export const sendCommand = (ws, target, cmd, args) => {
   ws.send(JSON.stringify({
     "target": target,
@@ -9,3 +12,27 @@ export const sendCommand = (ws, target, cmd, args) => {
     "args": args,
   }))
 }
+
+// Apply a JSON merge patch (RFC 7396) to a view, without changing the view
+export const mergePatch = (view, patch) => {
+  if (patch === null || typeof patch != 'object' || Array.isArray(patch)) {
+    return patch
+  }
+  let ret = {}
+  if (view != null && typeof view == 'object' && !Array.isArray(view)) {
+    ret = { ...view }
+  }
+  Object.keys(patch).forEach((key) => {
+    if (patch[key] === null) {
+      delete ret[key]
+    } else {
+      ret[key] = mergePatch(ret[key], patch[key])
+    }
+  })
+  return ret
+}
+
+// Where the session token for reconnecting to a lobby is kept
+export const sessionKey = (lobby, user) => {
+  return `bunga-session-${lobby}-${user}`
+}
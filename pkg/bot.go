@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Bot difficulty levels
+const (
+	BotRandom string = "random" // picks any legal move
+	BotMemory string = "memory" // remembers every card it's seen and plays to keep its hand low
+)
+
+var botLevels = map[string]struct{}{
+	BotRandom: {},
+	BotMemory: {},
+}
+
+const botDelay = 700 * time.Millisecond
+
+// What a memory bot assumes a card it hasn't seen is worth, about the deck average
+const unknownValue = 7
+
+// A bot has:
+// - the player id it plays as
+// - a difficulty level
+// - its own random source
+// - the latest view of the game it was sent, the same one a user would get
+// - what it knows about each card in each hand, "" if it's never seen it
+// - the top of the discard pile and the drawn card, for following where cards go
+// - the discard pile top it last tried tagging, so it only tries once per card
+type bot struct {
+	id       string
+	level    string
+	rng      *rand.Rand
+	view     bungaUserState
+	known    map[string][]string
+	discard  string
+	drawn    string
+	triedTag string
+}
+
+func newBot(id string, level string, seed int64) *bot {
+	return &bot{
+		id:    id,
+		level: level,
+		rng:   rand.New(rand.NewSource(seed)),
+		known: map[string][]string{},
+	}
+}
+
+// Main bot function:
+// - stands in for a user's websocket reader and writer
+// - reads messages the lobby sends to the user, and keeps the latest game view
+// - after a short delay, sends the move it wants to make for the latest view
+// - a newer view replaces any move that hasn't been sent yet
+// - returns once the user is removed from the lobby
+func (bt *bot) run(u *user) {
+	var out webMsg
+	var outCh chan webMsg
+	var timer <-chan time.Time
+	for {
+		select {
+		case message := <-u.lobbyToWeb:
+			var msg struct {
+				Target string
+				State  json.RawMessage
+			}
+			if err := json.Unmarshal(message, &msg); err != nil {
+				continue
+			}
+			var move *userMsg
+			switch msg.Target {
+			case TargetGame:
+				var view bungaUserState
+				if err := json.Unmarshal(msg.State, &view); err != nil {
+					fmt.Println("bot couldn't read game state:", err)
+					continue
+				}
+				bt.observe(view)
+				move = bt.nextMove()
+			case TargetError:
+				// the last move was rejected, so try something random instead of waiting forever
+				fmt.Println("bot", bt.id, "move rejected:", string(msg.State))
+				if bt.view.Turn == bt.id {
+					move = bt.randomMove()
+				}
+			default:
+				continue
+			}
+			outCh = nil
+			timer = nil
+			if move != nil {
+				out.user = u.id
+				out.data, _ = json.Marshal(move)
+				timer = time.After(botDelay)
+			}
+		case <-timer:
+			timer = nil
+			outCh = u.webToLobby
+		case outCh <- out:
+			outCh = nil
+		case <-u.quit:
+			return
+		}
+	}
+}
+
+// strip the highlight off a card from a view
+func cardFace(card string) string {
+	if len(card) < 2 {
+		return card
+	}
+	return card[:2]
+}
+
+// Take in a new view of the game:
+// - follow the latest actions so remembered cards stay at the right index
+// - forget hands that don't match the view any more
+// - remember any card that's face up in the view
+func (bt *bot) observe(view bungaUserState) {
+	bt.view = view
+	if view.Turn == Final {
+		return
+	}
+	// start of a new game, only the initial peek is visible
+	if view.Turn == "" && view.PlayersReady[bt.id] == "" {
+		bt.known = map[string][]string{}
+		bt.triedTag = ""
+	}
+	bt.followActions(view.LatestAction)
+	for player, hand := range view.PlayerHands {
+		if len(bt.known[player]) != len(hand) {
+			bt.known[player] = make([]string, len(hand))
+		}
+		for i, card := range hand {
+			if cardFace(card) != Back {
+				bt.known[player][i] = cardFace(card)
+			}
+		}
+	}
+	bt.discard = cardFace(view.DiscardPile)
+	if view.Turn == bt.id && view.PlayingState == DrawChoice {
+		bt.drawn = cardFace(view.DrawPile)
+	}
+}
+
+// Move remembered cards around to match the actions in the latest move
+func (bt *bot) followActions(actions []bungaAction) {
+	if bt.level != BotMemory || len(actions) == 0 {
+		return
+	}
+	isHand := func(pos string) bool {
+		return pos != Draw && pos != Discard
+	}
+	first := actions[0]
+	startIdx, _ := strconv.Atoi(first.StartIdx)
+	switch {
+	case len(actions) == 1 && isHand(first.Start) && first.End == Discard:
+		// tagged a card onto the discard pile
+		hand := bt.known[first.Start]
+		if startIdx < len(hand) {
+			bt.known[first.Start] = append(hand[:startIdx], hand[startIdx+1:]...)
+		}
+	case len(actions) >= 2 && actions[1].Card == Wrong:
+		// wrong tag, the tagger picked up unknown penalty cards, unless there were none left to pick up
+		for _, action := range actions[2:] {
+			if action.End == first.Start {
+				bt.known[first.Start] = append(bt.known[first.Start], "")
+			}
+		}
+	case len(actions) == 2 && isHand(first.End) && actions[1].End == Discard:
+		// swapped a hand card with the drawn card or the discard top
+		endIdx, _ := strconv.Atoi(first.EndIdx)
+		hand := bt.known[first.End]
+		if endIdx >= len(hand) {
+			return
+		}
+		hand[endIdx] = ""
+		if first.Start == Discard {
+			hand[endIdx] = bt.discard
+		} else if first.End == bt.id {
+			hand[endIdx] = bt.drawn
+		}
+	case len(actions) == 2 && isHand(first.Start) && isHand(first.End):
+		// swapped cards between two hands
+		endIdx, _ := strconv.Atoi(first.EndIdx)
+		from, to := bt.known[first.Start], bt.known[first.End]
+		if startIdx < len(from) && endIdx < len(to) {
+			from[startIdx], to[endIdx] = to[endIdx], from[startIdx]
+		}
+	}
+}
+
+// What a card in a hand is probably worth
+func (bt *bot) estimate(player string, idx int) int {
+	if idx < len(bt.known[player]) && bt.known[player][idx] != "" {
+		return bt.view.Rules.cardValue(bt.known[player][idx])
+	}
+	return unknownValue
+}
+
+// The own card that's probably worth the most, unknown cards first if there's a tie
+func (bt *bot) worstOwn() int {
+	worst := 0
+	for i := range bt.view.PlayerHands[bt.id] {
+		if bt.estimate(bt.id, i) > bt.estimate(bt.id, worst) ||
+			(bt.estimate(bt.id, i) == bt.estimate(bt.id, worst) && bt.known[bt.id][i] == "") {
+			worst = i
+		}
+	}
+	return worst
+}
+
+// Hands of players whose cards can be looked at or swapped
+func (bt *bot) others() []string {
+	ret := []string{}
+	for _, player := range bt.view.PlayerOrder {
+		if player != bt.id && player != bt.view.SaidBunga {
+			ret = append(ret, player)
+		}
+	}
+	return ret
+}
+
+func (bt *bot) cardMsg(owner string, idx int) *userMsg {
+	return &userMsg{TargetGame, Card, map[string]string{
+		Player: bt.id,
+		Owner:  owner,
+		Index:  strconv.Itoa(idx),
+	}}
+}
+
+func (bt *bot) cmdMsg(cmd string) *userMsg {
+	return &userMsg{TargetGame, cmd, map[string]string{Player: bt.id}}
+}
+
+func (bt *bot) randomOwn() *userMsg {
+	return bt.cardMsg(bt.id, bt.rng.Intn(len(bt.view.PlayerHands[bt.id])))
+}
+
+// Pick a card in someone else's hand, preferring ones the bot hasn't seen
+// if lowest is set, prefers the lowest known card instead
+func (bt *bot) pickOther(lowest bool) *userMsg {
+	others := bt.others()
+	if len(others) == 0 {
+		return bt.randomOwn()
+	}
+	if bt.level == BotMemory {
+		bestPlayer, bestIdx := "", 0
+		for _, player := range others {
+			for i := range bt.view.PlayerHands[player] {
+				known := bt.known[player][i] != ""
+				if !lowest && !known {
+					return bt.cardMsg(player, i)
+				}
+				if lowest && known && (bestPlayer == "" || bt.estimate(player, i) < bt.estimate(bestPlayer, bestIdx)) {
+					bestPlayer, bestIdx = player, i
+				}
+			}
+		}
+		if bestPlayer != "" {
+			return bt.cardMsg(bestPlayer, bestIdx)
+		}
+	}
+	player := others[bt.rng.Intn(len(others))]
+	return bt.cardMsg(player, bt.rng.Intn(len(bt.view.PlayerHands[player])))
+}
+
+// Work out the next move from the latest view, nil if there's nothing to do
+func (bt *bot) nextMove() *userMsg {
+	view := bt.view
+	hand := view.PlayerHands[bt.id]
+	if len(hand) == 0 || view.Turn == Final {
+		return nil
+	}
+	if view.Turn == "" {
+		if view.PlayersReady[bt.id] == "" {
+			return bt.cardMsg(bt.id, 0)
+		}
+		return nil
+	}
+	if move := bt.tag(); move != nil {
+		return move
+	}
+	if view.Turn != bt.id {
+		return nil
+	}
+	if bt.level == BotMemory {
+		return bt.memoryMove()
+	}
+	return bt.randomMove()
+}
+
+// Tag a remembered card matching the top of the discard pile
+func (bt *bot) tag() *userMsg {
+	view := bt.view
+	if bt.level != BotMemory || view.SaidBunga == bt.id || len(view.PlayerHands[bt.id]) < 2 {
+		return nil
+	}
+	if view.Turn == bt.id && view.PlayingState != StartTurn {
+		return nil
+	}
+	if bt.discard == Blank || bt.discard == bt.triedTag {
+		return nil
+	}
+	for i, card := range bt.known[bt.id] {
+		if card != "" && cardRank(card) == cardRank(bt.discard) {
+			bt.triedTag = bt.discard
+			return bt.cardMsg(bt.id, i)
+		}
+	}
+	return nil
+}
+
+func (bt *bot) randomMove() *userMsg {
+	view := bt.view
+	switch view.PlayingState {
+	case StartTurn:
+		if view.SaidBunga == "" && bt.rng.Intn(10) == 0 {
+			return bt.cmdMsg(Bunga)
+		}
+		if cardFace(view.DiscardPile) != Blank && bt.rng.Intn(3) == 0 {
+			return bt.cmdMsg(Discard)
+		}
+		return bt.cmdMsg(Draw)
+	case DrawChoice:
+		if bt.rng.Intn(2) == 0 {
+			return bt.cmdMsg(Discard)
+		}
+		return bt.randomOwn()
+	case LookOtherChoice, LookingOther, SwapOtherChoice, LookSwapChoice:
+		return bt.pickOther(false)
+	case LookSwapOwnChoice:
+		if bt.rng.Intn(2) == 0 {
+			return bt.pickOther(false)
+		}
+		return bt.randomOwn()
+	}
+	return bt.randomOwn()
+}
+
+func (bt *bot) memoryMove() *userMsg {
+	view := bt.view
+	hand := view.PlayerHands[bt.id]
+	worst := bt.worstOwn()
+	switch view.PlayingState {
+	case StartTurn:
+		total, unknown := 0, 0
+		for i := range hand {
+			total += bt.estimate(bt.id, i)
+			if bt.known[bt.id][i] == "" {
+				unknown++
+			}
+		}
+		if view.SaidBunga == "" && unknown == 0 && total <= 5 {
+			return bt.cmdMsg(Bunga)
+		}
+		if bt.discard != Blank && bt.view.Rules.cardValue(bt.discard) <= 3 && bt.estimate(bt.id, worst) > bt.view.Rules.cardValue(bt.discard)+3 {
+			return bt.cmdMsg(Discard)
+		}
+		return bt.cmdMsg(Draw)
+	case DrawChoice:
+		drawn := bt.view.Rules.cardValue(bt.drawn)
+		if drawn < bt.estimate(bt.id, worst) && (drawn <= 4 || drawn < bt.estimate(bt.id, worst)-2) {
+			return bt.cardMsg(bt.id, worst)
+		}
+		return bt.cmdMsg(Discard)
+	case DiscardSwapChoice, SwapOtherOwnChoice:
+		return bt.cardMsg(bt.id, worst)
+	case LookOwnChoice:
+		for i, card := range bt.known[bt.id] {
+			if card == "" {
+				return bt.cardMsg(bt.id, i)
+			}
+		}
+		return bt.cardMsg(bt.id, 0)
+	case LookingOwn:
+		return bt.cardMsg(bt.id, 0)
+	case LookOtherChoice, LookSwapChoice:
+		return bt.pickOther(false)
+	case LookingOther:
+		return bt.pickOther(false)
+	case SwapOtherChoice:
+		return bt.pickOther(true)
+	case LookSwapOwnChoice:
+		// the card picked from someone else is face up, take it if it beats the worst own card
+		for _, player := range bt.others() {
+			for i, card := range view.PlayerHands[player] {
+				if cardFace(card) == Back {
+					continue
+				}
+				if bt.view.Rules.cardValue(cardFace(card)) < bt.estimate(bt.id, worst) {
+					return bt.cardMsg(bt.id, worst)
+				}
+				return bt.cardMsg(player, i)
+			}
+		}
+		return bt.pickOther(false)
+	}
+	return bt.randomOwn()
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"sort"
 	"strconv"
-	"strings"
+	"time"
 )
 
 const Back = "1B"
 const Blank = "2B" // Used for empty discard pile
 const Wrong = "X"  // Used for incorrect tag
 const StartHandSize = 4
+const deckSize = 52
+const minDrawPile = 12 // Cards left in the draw pile once everyone is dealt in
 
 // Game states
 const (
@@ -31,6 +34,10 @@ const (
 	Owner   string = "owner"
 	Index   string = "index"
 	Bunga   string = "bunga"
+	Seed    string = "seed"
+	First   string = "first"
+	Timer   string = "timer"
+	Timeout string = "timeout"
 )
 
 // Playing states
@@ -76,249 +83,478 @@ type bungaUserState struct {
 	Turn         string
 	PlayersReady map[string]string
 	PlayerHands  map[string][]string
+	Remembered   map[string][]string
 	SaidBunga    string
 	Scores       map[string]int
 	PlayerOrder  []string
 	PlayingState string
 	Winner       string
+	Seed         int64
+	Rules        bungaRules
+	TimeLeft     int
 }
 
 type bungaGameState struct {
-	DrawPile     []string
-	DiscardPile  []string
-	LatestAction []bungaAction
-	LatestTag    string
-	CardSelected string
-	Turn         string
-	PlayersReady map[string]string
-	PlayerHands  map[string][]string
-	SaidBunga    string
-	GameState    string
-	PlayingState string
-	Scores       map[string]int
-	PlayerOrder  []string
-	Winner       string
+	DrawPile      []string
+	DiscardPile   []string
+	LatestAction  []bungaAction
+	LatestTag     string
+	SelectedOwner string
+	SelectedIdx   int
+	Turn          string
+	PlayersReady  map[string]string
+	PlayerHands   map[string][]string
+	Knowledge     map[string][]cardKnowledge
+	SaidBunga     string
+	GameState     string
+	PlayingState  string
+	Scores        map[string]int
+	PlayerOrder   []string
+	Winner        string
+	Seed          int64
+	Shuffles      int
+	Turns         int
+	Rules         bungaRules
+}
+
+// One processed move in a game's event log
+type bungaEvent struct {
+	Msg      userMsg
+	Accepted bool
+	Error    *gameError
+	Actions  []bungaAction
 }
 
+// The event log has everything needed to replay a game:
+// - the seed, house rules and player order, which reproduce the initial deal
+// - the initial deal itself, for reading the log by hand
+// - every message the game got, whether it changed the state, and the resulting actions
+type bungaLog struct {
+	Seed        int64
+	Rules       bungaRules
+	PlayerOrder []string
+	PlayerHands map[string][]string
+	DrawPile    []string
+	Events      []bungaEvent
+}
+
+// A bunga game running in a lobby has:
+// - channels to and from the lobby
+// - the game state, which only changes through Apply, and the event log
+// - the turn clock for the latest turn
+// - how many turns in a row each player has run out of time on
+// - the players who've left the lobby for good, whose moves are made for them
 type bunga struct {
-	in    chan userMsg
-	out   chan gameMsg
-	lobby *lobbyState
-	state bungaGameState
+	in        chan userMsg
+	out       chan gameMsg
+	state     bungaGameState
+	log       bungaLog
+	clock     *time.Timer
+	clockTurn int
+	deadline  time.Time
+	timeouts  map[string]int
+	gone      map[string]bool
 }
 
-func (b *bunga) reshuffleDiscardPile() {
-	// put all but the top card of the discard pile back into the draw pile, then shuffle the draw pile
-	for i := 0; i < len(b.state.DiscardPile)-1; i++ {
-		b.state.DrawPile = append(b.state.DrawPile, b.state.DiscardPile[i])
+func (s *bungaGameState) reshuffleDiscardPile() {
+	// shuffle all but the top card of the discard pile and put them under the draw pile
+	// so whatever's left on top of the draw pile, and what's known about it, stays put
+	if len(s.DiscardPile) < 2 {
+		return
 	}
-	rand.Shuffle(len(b.state.DrawPile), func(i, j int) {
-		b.state.DrawPile[i], b.state.DrawPile[j] = b.state.DrawPile[j], b.state.DrawPile[i]
+	top := len(s.DiscardPile) - 1
+	under := append([]string{}, s.DiscardPile[:top]...)
+	s.shuffle(under)
+	s.DrawPile = append(under, s.DrawPile...)
+	s.DiscardPile = append([]string{}, s.DiscardPile[top:]...)
+}
+
+// Every shuffle gets a source derived from the game's seed and the number of shuffles so far,
+// so the same seed always reproduces the same deal and the same reshuffles
+func (s *bungaGameState) shuffle(cards []string) {
+	r := rand.New(rand.NewSource(mixSeed(s.Seed, int64(s.Shuffles))))
+	s.Shuffles++
+	r.Shuffle(len(cards), func(i, j int) {
+		cards[i], cards[j] = cards[j], cards[i]
 	})
 }
 
-func (b *bunga) drawCard() string {
-	card := b.drawTop()
-	b.state.DrawPile = b.state.DrawPile[:len(b.state.DrawPile)-1]
-	if len(b.state.DrawPile) == 1 {
-		b.reshuffleDiscardPile()
+// Mix a seed and a counter into the seed of a source of their own, with splitmix64
+// so a seed's sources share nothing with those of the seeds next to it, like adding them would
+func mixSeed(seed int64, n int64) int64 {
+	return int64(splitmix(splitmix(uint64(seed)) + uint64(n)))
+}
+
+func splitmix(z uint64) uint64 {
+	z += 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *bungaGameState) drawCard() string {
+	// penalty cards can take the last one
+	if len(s.DrawPile) == 0 {
+		s.reshuffleDiscardPile()
+	}
+	card := s.drawTop()
+	s.DrawPile = s.DrawPile[:len(s.DrawPile)-1]
+	s.forgetDrawTop()
+	return card
+}
+
+// Penalty cards come from the top of the draw pile, or from under the card the player whose turn it is drew
+func (s *bungaGameState) drawPenalty() string {
+	if s.GameState != Playing || s.PlayingState != DrawChoice {
+		return s.drawCard()
 	}
+	if len(s.DrawPile) < 2 {
+		s.reshuffleDiscardPile()
+	}
+	under := len(s.DrawPile) - 2
+	card := s.DrawPile[under]
+	s.DrawPile = append(s.DrawPile[:under], s.DrawPile[under+1:]...)
 	return card
 }
 
-func (b *bunga) drawTop() string {
-	return b.state.DrawPile[len(b.state.DrawPile)-1]
+// Once the draw pile's down to its last card, shuffle the discard pile back into it
+// done after each move, so whatever the move discarded goes back in too
+func (s *bungaGameState) topUpDrawPile() {
+	if len(s.DrawPile) <= 1 {
+		s.reshuffleDiscardPile()
+	}
 }
 
-func (b *bunga) discardTop() string {
-	if len(b.state.DiscardPile) == 0 {
+func (s *bungaGameState) drawTop() string {
+	return s.DrawPile[len(s.DrawPile)-1]
+}
+
+func (s *bungaGameState) discardTop() string {
+	if len(s.DiscardPile) == 0 {
 		return Blank
 	}
-	return b.state.DiscardPile[len(b.state.DiscardPile)-1]
+	return s.DiscardPile[len(s.DiscardPile)-1]
 }
 
-func (b *bunga) advanceTurn() {
+func (s *bungaGameState) advanceTurn() {
 	curTurnIdx := 0
-	for i, player := range b.state.PlayerOrder {
-		if b.state.Turn == player {
+	for i, player := range s.PlayerOrder {
+		if s.Turn == player {
 			curTurnIdx = i
 		}
 	}
-	nextTurnIdx := (curTurnIdx + 1) % len(b.state.PlayerOrder)
-	b.state.Turn = b.state.PlayerOrder[nextTurnIdx]
-	if b.state.Turn == b.state.SaidBunga {
-		b.state.GameState = EndGame
+	nextTurnIdx := (curTurnIdx + 1) % len(s.PlayerOrder)
+	s.Turn = s.PlayerOrder[nextTurnIdx]
+	s.Turns++
+	s.hideAll()
+	if s.Turn == s.SaidBunga {
+		s.GameState = EndGame
 	}
 }
 
-func (b *bunga) initDeckCards() {
+func (s *bungaGameState) initDeckCards() {
+	s.DrawPile = newDeck(s.Rules)
+	s.shuffle(s.DrawPile)
+}
+
+// Every card the game is played with, in order
+func newDeck(rules bungaRules) []string {
 	suits := []string{"C", "D", "H", "S"}
 	names := []string{"2", "3", "4", "5", "6", "7", "8", "9", "T", "J", "Q", "K", "A"}
-	b.state.DrawPile = []string{}
-	for _, suit := range suits {
-		for _, name := range names {
-			b.state.DrawPile = append(b.state.DrawPile, name+suit)
+	ret := []string{}
+	for deck := 0; deck < rules.Decks; deck++ {
+		for _, suit := range suits {
+			for _, name := range names {
+				ret = append(ret, name+suit)
+			}
+		}
+		if rules.Jokers {
+			ret = append(ret, jokerCards...)
 		}
 	}
-	rand.Shuffle(len(b.state.DrawPile), func(i, j int) {
-		b.state.DrawPile[i], b.state.DrawPile[j] = b.state.DrawPile[j], b.state.DrawPile[i]
-	})
+	return ret
 }
 
-func (b *bunga) initPlayerHands() {
-	b.state.PlayerHands = map[string][]string{}
-	for _, player := range b.state.PlayerOrder {
-		for i := 0; i < StartHandSize; i++ {
-			b.state.PlayerHands[player] = append(b.state.PlayerHands[player], b.drawCard())
+// Remember which card the player whose turn it is picked, by where it is
+// since with more than one deck there can be several of the same card
+func (s *bungaGameState) selectCard(owner string, idx int) {
+	s.SelectedOwner = owner
+	s.SelectedIdx = idx
+}
+
+func (s *bungaGameState) clearSelection() {
+	s.SelectedOwner = ""
+	s.SelectedIdx = 0
+}
+
+func (s *bungaGameState) isSelected(owner string, idx int) bool {
+	return s.SelectedOwner == owner && s.SelectedIdx == idx
+}
+
+// The choice states to go back to if someone tags away the card that was picked from their hand
+var selectionChoiceStates = map[string]string{
+	LookingOther:       LookOtherChoice,
+	SwapOtherOwnChoice: SwapOtherChoice,
+	LookSwapOwnChoice:  LookSwapChoice,
+}
+
+// Take a tagged card out of a hand, keeping the selection pointing at the same card
+func (s *bungaGameState) removeFromHand(owner string, idx int) {
+	s.takeCard(owner, idx)
+	if s.SelectedOwner != owner || s.SelectedIdx < idx {
+		return
+	}
+	if s.SelectedIdx > idx {
+		s.SelectedIdx--
+		return
+	}
+	// the picked card is gone, so pick again
+	s.clearSelection()
+	if choice, ok := selectionChoiceStates[s.PlayingState]; ok {
+		s.PlayingState = choice
+	}
+}
+
+// Swap the picked card in someone else's hand with one of the player's own, ending their turn
+func (s *bungaGameState) swapSelected(player string, idx int) {
+	other, otherIdx := s.SelectedOwner, s.SelectedIdx
+	s.swapCards(player, idx, other, otherIdx)
+	idxStr, otherIdxStr := strconv.Itoa(idx), strconv.Itoa(otherIdx)
+	s.LatestAction = []bungaAction{
+		{Start: player, StartIdx: idxStr, End: other, EndIdx: otherIdxStr},
+		{Start: other, StartIdx: otherIdxStr, End: player, EndIdx: idxStr},
+	}
+	s.clearSelection()
+	s.advanceTurn()
+	s.PlayingState = StartTurn
+}
+
+func (s *bungaGameState) initPlayerHands() {
+	s.PlayerHands = map[string][]string{}
+	for _, player := range s.PlayerOrder {
+		for i := 0; i < s.Rules.HandSize; i++ {
+			s.PlayerHands[player] = append(s.PlayerHands[player], s.drawCard())
 		}
 	}
 }
 
-func (b *bunga) initPlayerOrder() {
-	order := b.lobby.Players
-	sort.Slice(order, func(i, j int) bool {
-		return b.lobby.Scores[order[i]] > b.lobby.Scores[order[j]]
+// The lobby's players by lobby score, highest first, leaving the lobby's own list alone
+func playerOrder(players []string, scores map[string]int) []string {
+	order := append([]string{}, players...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
 	})
-	b.state.PlayerOrder = order
+	return order
 }
 
-func createBunga(l *lobbyState, in chan userMsg, out chan gameMsg) game {
-	ret := &bunga{
-		in:    in,
-		out:   out,
-		lobby: l,
-		state: bungaGameState{
-			DiscardPile: []string{},
-			SaidBunga:   "",
-			GameState:   StartGame,
-		},
+// Start the player order from the given player, keeping everyone else in the same seats
+func rotatePlayerOrder(order []string, first string) ([]string, error) {
+	for i, player := range order {
+		if player == first {
+			return append(append([]string{}, order[i:]...), order[:i]...), nil
+		}
 	}
-	ret.initDeckCards()
-	ret.initPlayerOrder()
-	ret.state.Turn = ret.state.PlayerOrder[0]
-	ret.initPlayerHands()
+	return nil, fmt.Errorf("%q isn't playing", first)
+}
 
-	ret.state.PlayersReady = make(map[string]string)
-	for _, player := range ret.state.PlayerOrder {
-		ret.state.PlayersReady[player] = ""
+func init() {
+	registerGame(gameType{
+		info: gameInfo{
+			Name:       "bunga",
+			MinPlayers: 1,
+			MaxPlayers: defaultRules().maxPlayers(),
+			// a lobby fits a game dealt from a single deck, unless the host asks for more room
+			DefaultPlayers: defaultRules().oneDeckPlayers(),
+			Options: []gameOption{
+				{Name: Seed, Description: "Seed for shuffling, reuse one to replay the same deal", Default: "random"},
+				{Name: First, Description: "Player who takes the first turn", Default: "highest lobby score"},
+				{Name: HandSize, Description: "Cards everyone is dealt", Default: strconv.Itoa(StartHandSize)},
+				{Name: PeekCount, Description: "Cards everyone gets to look at before the game starts", Default: "2"},
+				{Name: RedKingScore, Description: "Points a red king is worth at the end", Default: "-1"},
+				{Name: BungaPenalty, Description: "Points added for calling bunga too early", Default: "10"},
+				{Name: BungaThreshold, Description: "Calling bunga with this many points or more is too early", Default: "10"},
+				{Name: TagPenalty, Description: "Cards picked up for tagging the wrong card", Default: "1"},
+				{Name: Powers, Description: "Discard powers by rank, as rank:power pairs using " + powerNames(), Default: "7:lookOwn,8:lookOwn,9:lookOther,T:lookOther,J:swap,Q:lookSwap"},
+				{Name: Decks, Description: fmt.Sprintf("Decks shuffled together, up to %d", maxDecks), Default: "enough for everyone"},
+				{Name: TurnTime, Description: fmt.Sprintf("Seconds everyone gets for a turn, up to %d, 0 for no turn clock", maxTurnTime), Default: "0"},
+				{Name: AwayAfter, Description: "Turns in a row someone can run out of time on before they're shown as away, 0 for never", Default: "2"},
+				{Name: Jokers, Description: "Shuffle the two jokers into the deck", Default: "false"},
+				{Name: JokerScore, Description: "Points a joker is worth at the end", Default: "0"},
+				{Name: JokerPower, Description: "What discarding a joker lets you do: " + powerNames(), Default: "none"},
+				{Name: AssistedMemory, Description: "Show everyone the cards they've seen, even after they've been swapped away", Default: "false"},
+			},
+		},
+		create: createBunga,
+		scores: func(g game) map[string]int {
+			return g.(*bunga).state.Scores
+		},
+		eventLog: func(g game) interface{} {
+			return &g.(*bunga).log
+		},
+		replay:  replayBunga,
+		restore: restoreBunga,
+		commands: []commandSpec{
+			{Target: TargetGame, Cmd: Draw, Description: "Draw a card at the start of your turn"},
+			{Target: TargetGame, Cmd: Discard, Description: "Take the top of the discard pile at the start of your turn, or discard the card you drew"},
+			{Target: TargetGame, Cmd: Bunga, Description: "Call bunga at the start of your turn, everyone else gets one more turn"},
+			{
+				Target: TargetGame, Cmd: Card, Description: "Click a card: to get ready, swap, look, tag or pick a card for a discard power",
+				Args: []argSpec{
+					{Name: Owner, Type: ArgString, Required: true, Description: "Whose hand the card is in"},
+					{Name: Index, Type: ArgInt, Required: true, Description: "Where the card is in their hand"},
+				},
+			},
+		},
+		view: bungaUserState{},
+	})
+}
+
+func createBunga(l *lobbyState, args map[string]string, in chan userMsg, out chan gameMsg) (game, error) {
+	seed := time.Now().UnixNano()
+	if args[Seed] != "" {
+		var err error
+		seed, err = strconv.ParseInt(args[Seed], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed %q", args[Seed])
+		}
+	}
+	rules, err := parseRules(args)
+	if err != nil {
+		return nil, err
+	}
+	order := playerOrder(l.Players, l.Scores)
+	if args[First] != "" {
+		if order, err = rotatePlayerOrder(order, args[First]); err != nil {
+			return nil, err
+		}
+	}
+	state, err := NewGame(rules, order, seed)
+	if err != nil {
+		return nil, err
+	}
+	ret := &bunga{
+		in:        in,
+		out:       out,
+		state:     state,
+		log:       newBungaLog(state),
+		clockTurn: -1,
+		timeouts:  map[string]int{},
+		gone:      map[string]bool{},
 	}
 
 	fmt.Println("created bunga:", ret)
-	return ret
+	return ret, nil
 }
 
-func (b *bunga) getBackHands() map[string][]string {
-	ret := map[string][]string{}
-	for _, player := range b.state.PlayerOrder {
-		hand := make([]string, len(b.state.PlayerHands[player]))
-		for i := 0; i < len(b.state.PlayerHands[player]); i++ {
-			hand[i] = Back
-			if b.state.SaidBunga == player {
-				hand[i] += BungHl
-			}
-		}
-		ret[player] = hand
+// Start the event log for a freshly dealt game
+func newBungaLog(state bungaGameState) bungaLog {
+	ret := bungaLog{
+		Seed:        state.Seed,
+		Rules:       state.Rules,
+		PlayerOrder: append([]string{}, state.PlayerOrder...),
+		PlayerHands: map[string][]string{},
+		DrawPile:    append([]string{}, state.DrawPile...),
+		Events:      []bungaEvent{},
+	}
+	for player, hand := range state.PlayerHands {
+		ret.PlayerHands[player] = append([]string{}, hand...)
 	}
 	return ret
 }
 
-func (b *bunga) computeScores() {
-	b.state.Scores = map[string]int{}
+// The playing state discarding a card from the draw pile leads to, or "" if it has no power
+func (s *bungaGameState) cardPower(card string) string {
+	power := s.Rules.power(card)
+	// if it's less than 2 players, only looking at your own cards is special
+	// if someone said bunga and there's less than 3 players,
+	// they'd have noone to affect, so those aren't special cards
+	if power != LookOwnChoice && (len(s.PlayerOrder) < 2 || (len(s.PlayerOrder) < 3 && s.SaidBunga != "")) {
+		return ""
+	}
+	return power
+}
+
+func (s *bungaGameState) computeScores() {
+	s.Scores = map[string]int{}
 	// Calculate base scores
-	for player, hand := range b.state.PlayerHands {
+	for player, hand := range s.PlayerHands {
 		score := 0
 		for _, card := range hand {
-			switch card[0] {
-			case 'A':
-				continue
-			case '2', '3', '4', '5', '6', '7', '8', '9':
-				num, _ := strconv.Atoi(string(card[0]))
-				score += num
-			case 'T', 'J', 'Q':
-				score += 10
-			case 'K':
-				if card[1] == 'H' || card[1] == 'D' {
-					score -= 1
-				} else {
-					score += 25
-				}
-			}
+			score += s.Rules.cardValue(card)
 		}
-		b.state.Scores[player] = score
+		s.Scores[player] = score
 	}
 	// Calculate penalty if bunga called incorrectly
-	if b.state.Scores[b.state.SaidBunga] >= 10 {
-		b.state.Scores[b.state.SaidBunga] += 10
+	if s.Scores[s.SaidBunga] >= s.Rules.BungaThreshold {
+		s.Scores[s.SaidBunga] += s.Rules.BungaPenalty
 	}
 	// Calculate penalty if bunga caller lost
-	minScore := b.state.Scores[b.state.PlayerOrder[0]]
-	minScorePlayer := b.state.PlayerOrder[0]
-	for player, score := range b.state.Scores {
-		if score < minScore {
-			minScore = score
+	minScore := s.Scores[s.PlayerOrder[0]]
+	minScorePlayer := s.PlayerOrder[0]
+	// go by the player order, so a tie always goes the same way
+	for _, player := range s.PlayerOrder {
+		if s.Scores[player] < minScore {
+			minScore = s.Scores[player]
 			minScorePlayer = player
 		}
 	}
 	// Determine winner
-	b.state.Winner = minScorePlayer
+	s.Winner = minScorePlayer
 }
 
-func (b *bunga) getUserStatesStartGame() map[string]bungaUserState {
+func (s *bungaGameState) getUserStatesStartGame() map[string]bungaUserState {
 	ret := map[string]bungaUserState{}
-	// have a map of hands full of card backs to use for everyone else
-	backHands := b.getBackHands()
 	// for each player, construct their own userState, which is their view of the game
-	for _, player := range b.state.PlayerOrder {
-		// construct PlayerHands. Use the back hand if it's not the players own hand.
-		playerHands := map[string][]string{}
-		for _, playerHand := range b.state.PlayerOrder {
-			// player gets to see their own hand's first two cards
-			// else they see a back hand
-			if player == playerHand && b.state.PlayersReady[player] == "" {
-				ownHand := []string{}
-				for i, card := range b.state.PlayerHands[player] {
-					if i < 2 {
-						ownHand = append(ownHand, card+PrimHl)
-					} else {
-						ownHand = append(ownHand, Back)
-					}
-				}
-				playerHands[player] = ownHand
-			} else {
-				playerHands[playerHand] = backHands[playerHand]
+	for _, player := range s.PlayerOrder {
+		// player sees the cards they're peeking at until they're ready, highlighted, and backs for the rest
+		playerHands := s.handsFor(player)
+		for i := range playerHands[player] {
+			if s.shownTo(player, player, i) {
+				playerHands[player][i] += PrimHl
 			}
 		}
 		ret[player] = bungaUserState{
 			DrawPile:     Back,
 			DiscardPile:  Blank,
 			Turn:         "",
-			PlayersReady: b.state.PlayersReady,
+			PlayersReady: s.PlayersReady,
 			PlayerHands:  playerHands,
-			PlayerOrder:  b.state.PlayerOrder,
+			Remembered:   s.rememberedBy(player),
+			PlayerOrder:  s.PlayerOrder,
+			Rules:        s.Rules,
 		}
 	}
+	ret[Spectators] = bungaUserState{
+		DrawPile:     Back,
+		DiscardPile:  Blank,
+		Turn:         "",
+		PlayersReady: s.PlayersReady,
+		PlayerHands:  s.handsFor(Spectators),
+		PlayerOrder:  s.PlayerOrder,
+		Rules:        s.Rules,
+	}
 	return ret
 }
 
-func (b *bunga) getUserStatesPlaying() map[string]bungaUserState {
-	fmt.Println("Bunga getting user states, playingState", b.state.PlayingState)
+func (s *bungaGameState) getUserStatesPlaying() map[string]bungaUserState {
 	ret := map[string]bungaUserState{}
 	// for each player, construct their view of the game
 	// 'player' is the player that sees the state
-	for _, player := range b.state.PlayerOrder {
-		backHands := b.getBackHands()
+	for _, player := range s.PlayerOrder {
+		// start from the cards that are face up for the player, and backs for the rest
+		hands := s.handsFor(player)
 		playerHands := map[string][]string{}
 		drawPile := Back
 		// discard pile is blank if empty, else it's the top card
-		discardPile := b.discardTop()
+		discardPile := s.discardTop()
 		// for each other players' hand, determine visibility + highlights, only if it's the players' turn though
 		// 'playerHand' is the player who's hand we want to set visibility for
-		for _, playerHand := range b.state.PlayerOrder {
-			playerHands[playerHand] = backHands[playerHand]
-			if b.state.Turn == player && b.state.Turn == playerHand {
+		for _, playerHand := range s.PlayerOrder {
+			playerHands[playerHand] = hands[playerHand]
+			if s.Turn == player && s.Turn == playerHand {
 				// construct player hands based on playingState
 				// if it's start turn it's all back, draw pile and discard pile highlighted if not empty
-				switch b.state.PlayingState {
+				switch s.PlayingState {
 				case StartTurn:
 					drawPile += PrimHl
 					if discardPile != Blank {
@@ -334,21 +570,18 @@ func (b *bunga) getUserStatesPlaying() map[string]bungaUserState {
 					for i, card := range playerHands[player] {
 						playerHands[player][i] = card + PrimHl
 					}
-					fmt.Println("Bunga draw pile:", strings.Join(b.state.DrawPile, ","))
-					fmt.Println("Bunga draw top", b.drawTop())
-					drawPile = b.drawTop()
+					if s.shownTo(player, Draw, 0) {
+						drawPile = s.drawTop()
+					}
 					discardPile += PrimHl
 				case LookOwnChoice:
 					for i := range playerHands[player] {
 						playerHands[player][i] += PrimHl
 					}
 				case LookingOwn:
-					for i, card := range b.state.PlayerHands[player] {
-						if card[:2] == b.state.CardSelected[:2] {
-							playerHands[player][i] = card + PrimHl
-						} else {
-							playerHands[player][i] += PrimHl
-						}
+					// the picked card is already face up
+					for i := range playerHands[player] {
+						playerHands[player][i] += PrimHl
 					}
 				case SwapOtherOwnChoice:
 					for i := range playerHands[player] {
@@ -360,31 +593,25 @@ func (b *bunga) getUserStatesPlaying() map[string]bungaUserState {
 					}
 				}
 			}
-			if b.state.Turn == player && b.state.Turn != playerHand {
+			if s.Turn == player && s.Turn != playerHand {
 				// here we worry about setting visibility for other players' hands
 				// e.g. for 9, 10, J, and Q
-				switch b.state.PlayingState {
+				switch s.PlayingState {
 				case LookOtherChoice:
 					for i := range playerHands[playerHand] {
 						playerHands[playerHand][i] += PrimHl
 					}
 				case LookingOther:
-					fmt.Println("getting vis for lookingOther, hand:", b.state.PlayerHands[playerHand])
-					fmt.Println("getting vis card selected:", b.state.CardSelected)
-					for i, card := range b.state.PlayerHands[playerHand] {
-						if card[:2] == b.state.CardSelected[:2] {
-							playerHands[playerHand][i] = card + PrimHl
-						} else {
-							playerHands[playerHand][i] += PrimHl
-						}
+					for i := range playerHands[playerHand] {
+						playerHands[playerHand][i] += PrimHl
 					}
 				case SwapOtherChoice:
 					for i := range playerHands[playerHand] {
 						playerHands[playerHand][i] += PrimHl
 					}
 				case SwapOtherOwnChoice:
-					for i, card := range b.state.PlayerHands[playerHand] {
-						if card[:2] == b.state.CardSelected[:2] {
+					for i := range s.PlayerHands[playerHand] {
+						if s.isSelected(playerHand, i) {
 							playerHands[playerHand][i] += SecoHl
 						}
 					}
@@ -393,12 +620,8 @@ func (b *bunga) getUserStatesPlaying() map[string]bungaUserState {
 						playerHands[playerHand][i] += PrimHl
 					}
 				case LookSwapOwnChoice:
-					for i, card := range b.state.PlayerHands[playerHand] {
-						if card[:2] == b.state.CardSelected[:2] {
-							playerHands[playerHand][i] = card + PrimHl
-						} else {
-							playerHands[playerHand][i] += PrimHl
-						}
+					for i := range playerHands[playerHand] {
+						playerHands[playerHand][i] += PrimHl
 					}
 				}
 			}
@@ -406,69 +629,124 @@ func (b *bunga) getUserStatesPlaying() map[string]bungaUserState {
 		ret[player] = bungaUserState{
 			DrawPile:     drawPile,
 			DiscardPile:  discardPile,
-			LatestAction: b.state.LatestAction,
-			Turn:         b.state.Turn,
+			LatestAction: s.LatestAction,
+			Turn:         s.Turn,
 			PlayerHands:  playerHands,
-			PlayerOrder:  b.state.PlayerOrder,
-			SaidBunga:    b.state.SaidBunga,
-			PlayingState: b.state.PlayingState,
+			Remembered:   s.rememberedBy(player),
+			PlayerOrder:  s.PlayerOrder,
+			SaidBunga:    s.SaidBunga,
+			PlayingState: s.PlayingState,
+			Rules:        s.Rules,
 		}
 	}
-	b.state.LatestAction = []bungaAction{}
+	// spectators only see card backs and the top of the discard pile
+	ret[Spectators] = bungaUserState{
+		DrawPile:     Back,
+		DiscardPile:  s.discardTop(),
+		LatestAction: s.LatestAction,
+		Turn:         s.Turn,
+		PlayerHands:  s.handsFor(Spectators),
+		PlayerOrder:  s.PlayerOrder,
+		SaidBunga:    s.SaidBunga,
+		PlayingState: s.PlayingState,
+		Rules:        s.Rules,
+	}
 	return ret
 }
 
-func (b *bunga) getUserStatesEndGame() map[string]bungaUserState {
-	b.computeScores()
+func (s *bungaGameState) getUserStatesEndGame() map[string]bungaUserState {
 	ret := map[string]bungaUserState{}
 	ret[Final] = bungaUserState{
 		DrawPile:    Back,
-		DiscardPile: b.discardTop(),
+		DiscardPile: s.discardTop(),
 		Turn:        Final,
-		PlayerHands: b.state.PlayerHands,
-		PlayerOrder: b.state.PlayerOrder,
-		Scores:      b.state.Scores,
-		Winner:      b.state.Winner,
+		PlayerHands: s.handsFor(Final),
+		PlayerOrder: s.PlayerOrder,
+		Scores:      s.Scores,
+		Winner:      s.Winner,
+		Seed:        s.Seed,
+		Rules:       s.Rules,
 	}
 	return ret
 }
 
-// compute visibility based on game state
-// also compute highlight status
+// Send everyone their view of the game, with the time left on the turn clock
 func (b *bunga) broadcastState() {
-	// call a getUserStates function depending on game state
-	// for each player in the lobby, send them their state
-	var userStates map[string]bungaUserState
-	switch b.state.GameState {
+	// every view at once, rather than working them all out again for each recipient through View
+	views := b.state.getUserStates()
+	if b.state.GameState == EndGame {
+		b.out <- gameMsg{Final, views[Final]}
+		return
+	}
+	timeLeft := b.timeLeft()
+	for _, player := range append(append([]string{}, b.state.PlayerOrder...), Spectators) {
+		view, ok := views[player]
+		if !ok {
+			view = views[Spectators]
+		}
+		view.TimeLeft = timeLeft
+		b.out <- gameMsg{player, view}
+	}
+}
+
+// call a getUserStates function depending on game state
+func (s *bungaGameState) getUserStates() map[string]bungaUserState {
+	switch s.GameState {
 	case StartGame:
-		userStates = b.getUserStatesStartGame()
+		return s.getUserStatesStartGame()
 	case Playing:
-		userStates = b.getUserStatesPlaying()
+		return s.getUserStatesPlaying()
 	case EndGame:
-		userStates = b.getUserStatesEndGame()
+		return s.getUserStatesEndGame()
 	}
+	return nil
+}
+
+// state machine ish functions to update game state
 
-	if b.state.GameState != EndGame {
-		for _, player := range b.state.PlayerOrder {
-			b.out <- gameMsg{player, userStates[player]}
+// Check a message is a well formed command from someone in the game, before it touches the game state
+func (s *bungaGameState) validateMove(msg userMsg) *gameError {
+	player := msg.Args[Player]
+	if _, ok := s.PlayersReady[player]; !ok {
+		return &gameError{ErrNotPlayer, player + " isn't playing in this game"}
+	}
+	switch msg.Cmd {
+	case Draw, Discard, Bunga:
+	case Card:
+		hand, ok := s.PlayerHands[msg.Args[Owner]]
+		if !ok {
+			return &gameError{ErrBadArgs, "unknown card owner " + strconv.Quote(msg.Args[Owner])}
+		}
+		idx, err := strconv.Atoi(msg.Args[Index])
+		if err != nil || idx < 0 || idx >= len(hand) {
+			return &gameError{ErrBadArgs, "no card at index " + strconv.Quote(msg.Args[Index])}
 		}
-	} else {
-		b.out <- gameMsg{Final, userStates[Final]}
+	default:
+		return &gameError{ErrBadCommand, "unknown command " + strconv.Quote(msg.Cmd)}
 	}
+	return nil
 }
 
-// state machine ish functions to update game state
-
-func (b *bunga) moveStartgameState(msg userMsg) {
+func (s *bungaGameState) moveStartgameState(msg userMsg) *gameError {
 	// Check if player is readying
 	player := msg.Args["player"]
 	idx, _ := strconv.Atoi(msg.Args["index"])
-	if player == msg.Args["owner"] && idx < 2 {
-		b.state.PlayersReady[player] = Ready
+	// without any cards to peek at, clicking any of your own means you're ready
+	peeked := s.Rules.PeekCount
+	if peeked == 0 {
+		peeked = len(s.PlayerHands[player])
+	}
+	if msg.Cmd != Card || player != msg.Args["owner"] || idx >= peeked {
+		return &gameError{ErrIllegalMove, fmt.Sprintf("look at your first %d cards, then click one of them when you're ready", peeked)}
+	}
+	if s.PlayersReady[player] == Ready {
+		return &gameError{ErrIllegalMove, "you're already ready"}
 	}
+	s.PlayersReady[player] = Ready
+	s.hideFrom(player)
 	// If all players are ready, go to playing state
 	allReady := true
-	for _, readyState := range b.state.PlayersReady {
+	for _, readyState := range s.PlayersReady {
 		readyBool := false
 		if readyState == Ready {
 			readyBool = true
@@ -477,14 +755,73 @@ func (b *bunga) moveStartgameState(msg userMsg) {
 	}
 	// Prep for starting game
 	if allReady {
-		fmt.Println("Bunga all players ready, starting game!")
-		b.state.GameState = Playing
-		b.state.PlayingState = StartTurn
-		b.state.Turn = b.state.PlayerOrder[0]
+		s.startPlaying()
+	}
+	return nil
+}
+
+func (s *bungaGameState) startPlaying() {
+	s.GameState = Playing
+	s.PlayingState = StartTurn
+	s.Turn = s.PlayerOrder[0]
+	// the first turn gets its own clock, separate from the time to get ready
+	s.Turns++
+	s.hideAll()
+}
+
+// States where the player whose turn it is can't tag, since clicking their own card means something else
+var notAllowedTagStates = map[string]struct{}{
+	DiscardSwapChoice:  {},
+	DrawChoice:         {},
+	LookOwnChoice:      {},
+	LookingOwn:         {},
+	SwapOtherOwnChoice: {},
+	LookSwapOwnChoice:  {},
+}
+
+// Check a move fits the current playing state, so movePlayingState never has to ignore anything
+func (s *bungaGameState) validatePlaying(msg userMsg) *gameError {
+	player := msg.Args[Player]
+	choseOwn := msg.Cmd == Card && player == msg.Args[Owner]
+	choseOther := msg.Cmd == Card && player != msg.Args[Owner] && s.SaidBunga != msg.Args[Owner]
+	_, disallowed := notAllowedTagStates[s.PlayingState]
+	if choseOwn && (s.Turn != player || !disallowed) {
+		if len(s.PlayerHands[player]) < 2 {
+			return &gameError{ErrIllegalMove, "you can't tag your last card"}
+		}
+		if player == s.SaidBunga {
+			return &gameError{ErrIllegalMove, "you can't tag after saying bunga"}
+		}
+		return nil
 	}
+	if s.Turn != player {
+		return &gameError{ErrNotYourTurn, "it's " + s.Turn + "'s turn"}
+	}
+	legal := false
+	switch s.PlayingState {
+	case StartTurn:
+		legal = msg.Cmd == Draw ||
+			(msg.Cmd == Discard && len(s.DiscardPile) > 0) ||
+			(msg.Cmd == Bunga && s.SaidBunga == "")
+	case DrawChoice:
+		legal = msg.Cmd == Discard || choseOwn
+	case DiscardSwapChoice, LookOwnChoice, LookingOwn, SwapOtherOwnChoice:
+		legal = choseOwn
+	case LookOtherChoice, LookingOther, SwapOtherChoice, LookSwapChoice:
+		legal = choseOther
+	case LookSwapOwnChoice:
+		legal = choseOwn || choseOther
+	}
+	if !legal {
+		return &gameError{ErrIllegalMove, "can't " + msg.Cmd + " during " + s.PlayingState}
+	}
+	return nil
 }
 
-func (b *bunga) movePlayingState(msg userMsg) {
+func (s *bungaGameState) movePlayingState(msg userMsg) *gameError {
+	if err := s.validatePlaying(msg); err != nil {
+		return err
+	}
 	// parse message for convenience
 	player := msg.Args[Player]
 	var idx int
@@ -494,240 +831,437 @@ func (b *bunga) movePlayingState(msg userMsg) {
 	var choseOther bool
 	if msg.Cmd == Card {
 		choseOwn = player == msg.Args[Owner]
-		choseOther = player != msg.Args[Owner] && b.state.SaidBunga != msg.Args[Owner]
+		choseOther = player != msg.Args[Owner] && s.SaidBunga != msg.Args[Owner]
 		idxStr = msg.Args[Index]
 		idx, _ = strconv.Atoi(msg.Args[Index])
-		card = b.state.PlayerHands[msg.Args[Owner]][idx]
+		card = s.PlayerHands[msg.Args[Owner]][idx]
 	}
 	// handle tagging logic
-	notAllowedTagStates := map[string]struct{}{
-		DiscardSwapChoice:  {},
-		DrawChoice:         {},
-		LookOwnChoice:      {},
-		LookingOwn:         {},
-		SwapOtherOwnChoice: {},
-		LookSwapOwnChoice:  {},
-	}
 	// your turn     not allowed state   allowed tag
 	//    false           false             true
 	//    false           true              true
 	//    true            false             true
 	//    true            true              false
-	_, disallowed := notAllowedTagStates[b.state.PlayingState]
-	tagAllowed := b.state.Turn != player || !disallowed
+	_, disallowed := notAllowedTagStates[s.PlayingState]
+	tagAllowed := s.Turn != player || !disallowed
 	if choseOwn && tagAllowed {
-		fmt.Println(player, "sent cmd 'Card' and tagAllowed:", tagAllowed)
-		if len(b.state.PlayerHands[player]) > 1 && player != b.state.SaidBunga {
+		if len(s.PlayerHands[player]) > 1 && player != s.SaidBunga {
 			canTag := true
 			// check if it's the right card
-			if card[0] != b.discardTop()[0] {
+			if cardRank(card) != cardRank(s.discardTop()) {
 				canTag = false
 			}
 			// check if the top of the discard pile is the last tagged card
 			// if so, we can't tag
-			if b.state.LatestTag != "" && b.state.LatestTag[0] == card[0] {
+			if s.LatestTag != "" && cardRank(s.LatestTag) == cardRank(card) {
 				canTag = false
 			}
-			b.state.LatestAction = []bungaAction{
+			s.LatestAction = []bungaAction{
 				{Start: player, StartIdx: idxStr, End: Discard},
 			}
 			// handle incorrect tag
 			if !canTag {
-				// add another card to hand
-				b.state.PlayerHands[player] = append(b.state.PlayerHands[player], b.drawCard())
 				// set latest actions
-				b.state.LatestAction = append(b.state.LatestAction,
+				s.LatestAction = append(s.LatestAction,
 					bungaAction{
 						Start: Discard, End: Discard,
 						Card: Wrong,
 					},
-					bungaAction{
-						Start: Draw, End: player,
-						EndIdx: strconv.Itoa(len(b.state.PlayerHands[player]) - 1),
-					},
 				)
+				// add penalty cards to hand, leaving enough in the draw and discard piles to keep drawing from
+				// a penalty card there's none left for is shown as a wrong card on the draw pile, so everyone sees it was skipped
+				for i := 0; i < s.Rules.TagPenalty; i++ {
+					if len(s.DrawPile)+len(s.DiscardPile) <= 2 {
+						s.LatestAction = append(s.LatestAction,
+							bungaAction{
+								Start: Draw, End: Draw,
+								Card: Wrong,
+							},
+						)
+						continue
+					}
+					s.addCard(player, s.drawPenalty(), cardKnowledge{})
+					s.LatestAction = append(s.LatestAction,
+						bungaAction{
+							Start: Draw, End: player,
+							EndIdx: strconv.Itoa(len(s.PlayerHands[player]) - 1),
+						},
+					)
+				}
 			} else {
 				// move card to discard pile
-				hand := b.state.PlayerHands[player]
-				b.state.PlayerHands[player] = append(hand[:idx], hand[idx+1:]...)
-				b.state.DiscardPile = append(b.state.DiscardPile, card)
-				// set b.state.LatestTag to the tagged card
-				b.state.LatestTag = card
+				s.removeFromHand(player, idx)
+				s.DiscardPile = append(s.DiscardPile, card)
+				// set s.LatestTag to the tagged card
+				s.LatestTag = card
 			}
 		}
 	}
 	// check if it's the right player
-	if b.state.Turn != player {
-		return
+	if s.Turn != player {
+		return nil
 	}
 	// based on the playingState, advance the state machine based on the given move
-	switch b.state.PlayingState {
+	switch s.PlayingState {
 	case StartTurn:
 		if msg.Cmd == Draw {
-			b.state.PlayingState = DrawChoice
-		} else if msg.Cmd == Discard && len(b.state.DiscardPile) > 0 {
-			b.state.PlayingState = DiscardSwapChoice
-		} else if msg.Cmd == Bunga && b.state.SaidBunga == "" {
-			b.state.SaidBunga = player
-			b.advanceTurn()
-			b.state.PlayingState = StartTurn
+			s.show(Draw, 0, player)
+			s.PlayingState = DrawChoice
+		} else if msg.Cmd == Discard && len(s.DiscardPile) > 0 {
+			s.PlayingState = DiscardSwapChoice
+		} else if msg.Cmd == Bunga && s.SaidBunga == "" {
+			s.SaidBunga = player
+			s.advanceTurn()
+			s.PlayingState = StartTurn
 		}
 	case DrawChoice:
 		if msg.Cmd == Discard || choseOwn {
-			cardType := b.drawTop()[0]
-			notSpecialTypes := map[byte]struct{}{
-				'A': {}, '2': {}, '3': {}, '4': {}, '5': {}, '6': {}, 'K': {},
-			}
-			// if it's less than 2 players, these aren't special cards
-			// if someone said bunga and there's less than 3 players,
-			// they'd have noone to affect, so they're not special cards
-			if len(b.state.PlayerOrder) < 2 || (len(b.state.PlayerOrder) < 3 && b.state.SaidBunga != "") {
-				for _, t := range []byte{'9', 'T', 'J', 'Q'} {
-					notSpecialTypes[t] = struct{}{}
-				}
-			}
+			power := s.cardPower(s.drawTop())
 			if msg.Cmd == Discard {
-				b.state.DiscardPile = append(b.state.DiscardPile, b.drawCard())
-				b.state.LatestAction = []bungaAction{
+				s.DiscardPile = append(s.DiscardPile, s.drawCard())
+				s.LatestAction = []bungaAction{
 					{Start: Draw, End: Discard},
 				}
-				if _, notSpecial := notSpecialTypes[cardType]; notSpecial {
-					b.advanceTurn()
-					b.state.PlayingState = StartTurn
+				if power == "" {
+					s.advanceTurn()
+					s.PlayingState = StartTurn
 				} else {
-					switch cardType {
-					case '7', '8':
-						b.state.PlayingState = LookOwnChoice
-					case '9', 'T':
-						if len(b.state.PlayerOrder) > 1 {
-							b.state.PlayingState = LookOtherChoice
-						} else {
-							b.state.PlayingState = LookOwnChoice
-						}
-					case 'J':
-						b.state.PlayingState = SwapOtherChoice
-					case 'Q':
-						b.state.PlayingState = LookSwapChoice
-					}
+					s.PlayingState = power
 				}
 			} else {
 				// top of draw pile -> clicked card
 				// clicked card -> discard pile
-				b.state.DiscardPile = append(b.state.DiscardPile, card)
-				b.state.PlayerHands[player][idx] = b.drawCard()
-				b.state.LatestAction = []bungaAction{
+				// the player keeps knowing the card they drew, it's just not face up any more
+				drawn := s.knowledge(Draw, 0)
+				drawn.ShownTo = nil
+				s.DiscardPile = append(s.DiscardPile, card)
+				s.replaceCard(player, idx, s.drawCard(), drawn)
+				s.LatestAction = []bungaAction{
 					{Start: Draw, End: player, EndIdx: idxStr},
 					{Start: player, StartIdx: idxStr, End: Discard},
 				}
-				b.advanceTurn()
-				b.state.PlayingState = StartTurn
+				s.advanceTurn()
+				s.PlayingState = StartTurn
 			}
 		}
 	case DiscardSwapChoice:
 		if choseOwn {
 			// Swap the discard top and the clicked card
-			b.state.PlayerHands[player][idx] = b.state.DiscardPile[len(b.state.DiscardPile)-1]
-			b.state.DiscardPile[len(b.state.DiscardPile)-1] = card
-			b.state.LatestAction = []bungaAction{
+			s.replaceCard(player, idx, s.DiscardPile[len(s.DiscardPile)-1], s.publicKnowledge())
+			s.DiscardPile[len(s.DiscardPile)-1] = card
+			s.LatestAction = []bungaAction{
 				{Start: Discard, End: player, EndIdx: idxStr},
 				{Start: player, StartIdx: idxStr, End: Discard},
 			}
-			b.advanceTurn()
-			b.state.PlayingState = StartTurn
+			s.advanceTurn()
+			s.PlayingState = StartTurn
 		}
 	case LookOwnChoice:
 		if choseOwn {
-			b.state.CardSelected = card
-			b.state.PlayingState = LookingOwn
+			s.selectCard(player, idx)
+			s.show(player, idx, player)
+			s.PlayingState = LookingOwn
 		}
 	case LookingOwn:
 		if choseOwn {
-			b.state.CardSelected = ""
-			b.advanceTurn()
-			b.state.PlayingState = StartTurn
+			s.clearSelection()
+			s.advanceTurn()
+			s.PlayingState = StartTurn
 		}
 	case LookOtherChoice:
 		if choseOther {
-			b.state.CardSelected = card
-			fmt.Println("Looking other, card selected:", card)
-			b.state.PlayingState = LookingOther
+			s.selectCard(msg.Args[Owner], idx)
+			s.show(msg.Args[Owner], idx, player)
+			s.PlayingState = LookingOther
 		}
 	case LookingOther:
 		if choseOther {
-			b.state.CardSelected = ""
-			b.advanceTurn()
-			b.state.PlayingState = StartTurn
+			s.clearSelection()
+			s.advanceTurn()
+			s.PlayingState = StartTurn
 		}
 	case SwapOtherChoice:
 		if choseOther {
-			b.state.CardSelected = card
-			b.state.PlayingState = SwapOtherOwnChoice
+			s.selectCard(msg.Args[Owner], idx)
+			s.PlayingState = SwapOtherOwnChoice
 		}
 	case SwapOtherOwnChoice:
 		if choseOwn {
-			for otherPlayer, hand := range b.state.PlayerHands {
-				for i, otherCard := range hand {
-					if otherCard == b.state.CardSelected {
-						b.state.PlayerHands[otherPlayer][i] = card
-						b.state.PlayerHands[player][idx] = otherCard
-						iStr := strconv.Itoa(i)
-						b.state.LatestAction = []bungaAction{
-							{Start: player, StartIdx: idxStr, End: otherPlayer, EndIdx: iStr},
-							{Start: otherPlayer, StartIdx: iStr, End: player, EndIdx: idxStr},
-						}
-						b.state.CardSelected = ""
-						b.advanceTurn()
-						b.state.PlayingState = StartTurn
-					}
-				}
-			}
+			s.swapSelected(player, idx)
 		}
 	case LookSwapChoice:
 		if choseOther {
-			b.state.CardSelected = card
-			b.state.PlayingState = LookSwapOwnChoice
+			s.selectCard(msg.Args[Owner], idx)
+			s.show(msg.Args[Owner], idx, player)
+			s.PlayingState = LookSwapOwnChoice
 		}
 	case LookSwapOwnChoice:
 		if choseOther {
-			b.state.CardSelected = ""
-			b.advanceTurn()
-			b.state.PlayingState = StartTurn
+			s.clearSelection()
+			s.advanceTurn()
+			s.PlayingState = StartTurn
 		}
 		if choseOwn {
-			for otherPlayer, hand := range b.state.PlayerHands {
-				for i, otherCard := range hand {
-					if otherCard == b.state.CardSelected {
-						b.state.PlayerHands[otherPlayer][i] = card
-						b.state.PlayerHands[player][idx] = otherCard
-						iStr := strconv.Itoa(i)
-						b.state.LatestAction = []bungaAction{
-							{Start: player, StartIdx: idxStr, End: otherPlayer, EndIdx: iStr},
-							{Start: otherPlayer, StartIdx: iStr, End: player, EndIdx: idxStr},
-						}
-						b.state.CardSelected = ""
-						b.advanceTurn()
-						b.state.PlayingState = StartTurn
-					}
-				}
+			s.swapSelected(player, idx)
+		}
+	}
+	return nil
+}
+
+// Apply a message to the game state and record it in the event log
+// A rejected message leaves the game state as it was
+func (b *bunga) move(msg userMsg) *gameError {
+	state, actions, err := Apply(b.state, msg)
+	if err == nil {
+		b.state = state
+		if checkInvariants {
+			for _, broken := range state.invariants() {
+				fmt.Println("Bunga invariant broken after", msg.Cmd, msg.Args, ":", broken)
 			}
 		}
 	}
+	b.log.Events = append(b.log.Events, bungaEvent{
+		Msg:      msg,
+		Accepted: err == nil,
+		Error:    err,
+		Actions:  actions,
+	})
+	return err
+}
+
+// Step through a finished game's event log, calling step with the given player's view
+// after the initial deal and after every event. Spectators gets the spectator view
+func replayBunga(eventLog interface{}, player string, step func(view interface{}) bool) error {
+	l, ok := eventLog.(*bungaLog)
+	if !ok {
+		return fmt.Errorf("not a bunga event log")
+	}
+	found := player == Spectators
+	for _, p := range l.PlayerOrder {
+		found = found || p == player
+	}
+	if !found {
+		return fmt.Errorf("%q didn't play in this game", player)
+	}
+	state, err := NewGame(l.Rules, l.PlayerOrder, l.Seed)
+	if err != nil {
+		return err
+	}
+	if !step(View(state, player)) {
+		return nil
+	}
+	for _, event := range l.Events {
+		if next, _, err := Apply(state, event.Msg); err == nil {
+			state = next
+		}
+		if !step(View(state, player)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Make the default move for whoever's turn it is once their time runs out:
+// - before the game starts, everyone who isn't ready yet is made ready
+// - at the start of the turn, draw and discard
+// - with a card drawn, discard it
+// - anything else, like a look or swap power, is skipped
+func (s *bungaGameState) timeout(msg userMsg) *gameError {
+	player := msg.Args[Player]
+	if s.GameState == StartGame {
+		for _, p := range s.PlayerOrder {
+			s.PlayersReady[p] = Ready
+		}
+		s.startPlaying()
+		return nil
+	}
+	if s.GameState != Playing || s.Turn != player {
+		return &gameError{ErrIllegalMove, "the turn clock ran out for " + player + " after their turn"}
+	}
+	if s.PlayingState == StartTurn {
+		s.movePlayingState(userMsg{Target: TargetGame, Cmd: Draw, Args: map[string]string{Player: player}})
+	}
+	if s.PlayingState == DrawChoice {
+		s.movePlayingState(userMsg{Target: TargetGame, Cmd: Discard, Args: map[string]string{Player: player}})
+	}
+	if s.Turn == player && s.PlayingState != StartTurn {
+		s.clearSelection()
+		s.advanceTurn()
+		s.PlayingState = StartTurn
+	}
+	return nil
+}
+
+// Start the turn clock whenever a new turn starts, the returned channel fires when it runs out
+// and is nil when there's no clock running
+func (b *bunga) turnClock() <-chan time.Time {
+	if b.state.Rules.TurnTime == 0 || b.state.GameState == EndGame {
+		return nil
+	}
+	if b.clockTurn != b.state.Turns {
+		if b.clock != nil {
+			b.clock.Stop()
+		}
+		turnTime := time.Duration(b.state.Rules.TurnTime) * time.Second
+		b.clock = time.NewTimer(turnTime)
+		b.clockTurn = b.state.Turns
+		b.deadline = time.Now().Add(turnTime)
+	}
+	return b.clock.C
+}
+
+// Whole seconds left on the turn clock, 0 if there isn't one
+func (b *bunga) timeLeft() int {
+	if b.deadline.IsZero() || b.state.GameState == EndGame {
+		return 0
+	}
+	left := time.Until(b.deadline)
+	if left < 0 {
+		return 0
+	}
+	return int((left + time.Second - 1) / time.Second)
+}
+
+// Count turns each player ran out of time on, telling the lobby when they've missed enough
+// to be away and when they're back
+func (b *bunga) countTimeouts(msg userMsg) {
+	player := msg.Args[Player]
+	awayAfter := b.state.Rules.AwayAfter
+	if player == "" || b.gone[player] {
+		return
+	}
+	if msg.Target == Timer {
+		b.timeouts[player]++
+		if awayAfter > 0 && b.timeouts[player] == awayAfter {
+			b.out <- gameMsg{"", awayNotice{player, true}}
+		}
+		return
+	}
+	if awayAfter > 0 && b.timeouts[player] >= awayAfter {
+		b.out <- gameMsg{"", awayNotice{player, false}}
+	}
+	b.timeouts[player] = 0
+}
+
+// The move made for a player who's left the lobby whenever the game's waiting on them:
+// they get ready straight away, and their turns run out as soon as they start
+// nothing's made for anyone once every player's left, so the game waits for the lobby to quit it
+func (b *bunga) goneMove() (userMsg, bool) {
+	if len(b.gone) == len(b.state.PlayerOrder) {
+		return userMsg{}, false
+	}
+	for _, player := range b.state.PlayerOrder {
+		if !b.gone[player] {
+			continue
+		}
+		if b.state.GameState == StartGame && b.state.PlayersReady[player] != Ready {
+			return userMsg{Target: TargetGame, Cmd: Card, Args: map[string]string{Player: player, Owner: player, Index: "0"}}, true
+		}
+		if b.state.GameState == Playing && b.state.Turn == player {
+			return userMsg{Target: Timer, Cmd: Timeout, Args: map[string]string{Player: player}}, true
+		}
+	}
+	return userMsg{}, false
+}
+
+// Everything needed to carry on a game after a restart, the turn clock starts over
+type bungaSnapshot struct {
+	State bungaGameState
+	Log   bungaLog
+}
+
+func (b *bunga) snapshot() gameSnapshot {
+	data, err := json.Marshal(bungaSnapshot{b.state, b.log})
+	if err != nil {
+		fmt.Println("Bunga couldn't snapshot:", err)
+	}
+	return data
+}
+
+func restoreBunga(l *lobbyState, snapshot []byte, in chan userMsg, out chan gameMsg) (game, error) {
+	var snap bungaSnapshot
+	if err := json.Unmarshal(snapshot, &snap); err != nil {
+		return nil, err
+	}
+	if snap.State.Knowledge == nil {
+		snap.State.initKnowledge()
+	}
+	ret := &bunga{
+		in:        in,
+		out:       out,
+		state:     snap.State,
+		log:       snap.Log,
+		clockTurn: -1,
+		timeouts:  map[string]int{},
+		gone:      map[string]bool{},
+	}
+	// anyone who lost their seat in the lobby isn't coming back
+	for _, player := range ret.state.PlayerOrder {
+		if !containsId(l.Players, player) {
+			ret.gone[player] = true
+		}
+	}
+	fmt.Println("restored bunga:", ret)
+	return ret, nil
 }
 
 func (b *bunga) runGame() {
 	fmt.Println("Bunga starting!")
-	go b.broadcastState()
-	for msg := range b.in {
+	b.out <- gameMsg{"", b.snapshot()}
+	b.turnClock()
+	b.broadcastState()
+	for {
+		var msg userMsg
+		if next, ok := b.goneMove(); ok {
+			msg = next
+		} else {
+			select {
+			case m, ok := <-b.in:
+				if !ok {
+					return
+				}
+				msg = m
+			case <-b.turnClock():
+				// nobody's turn while everyone's getting ready
+				turn := ""
+				if b.state.GameState == Playing {
+					turn = b.state.Turn
+				}
+				msg = userMsg{Target: Timer, Cmd: Timeout, Args: map[string]string{Player: turn}}
+			}
+		}
 		fmt.Println("Bunga got message, processing...")
 
 		fmt.Println(msg.Cmd, msg.Args)
-		if b.state.GameState == StartGame {
-			b.moveStartgameState(msg)
-		} else if b.state.GameState == Playing {
-			b.movePlayingState(msg)
+		if msg.Target == "quit" || msg.Cmd == "quit" {
+			fmt.Println("Bunga quit")
+			if b.clock != nil {
+				b.clock.Stop()
+			}
+			return
+		}
+		if msg.Cmd == gameResync {
+			b.broadcastState()
+			continue
+		}
+		if msg.Cmd == gameLeave {
+			b.gone[msg.Args[Player]] = true
+			continue
+		}
+		if err := b.move(msg); err != nil {
+			// only the player who sent the move hears about it
+			fmt.Println("Bunga rejected move:", err)
+			b.out <- gameMsg{msg.Args[Player], err}
+			continue
 		}
+		b.countTimeouts(msg)
+		b.out <- gameMsg{"", b.snapshot()}
+		// start the next turn's clock before sending out the views with the time left
+		b.turnClock()
 
 		b.broadcastState()
+		// the views have shown the latest actions, so a resync later on doesn't show them again
+		b.state.LatestAction = []bungaAction{}
 		if b.state.GameState == EndGame {
 			fmt.Println("Bunga done")
 			return
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// House rules the engine is tested with, and how many play
+var testTables = []struct {
+	name    string
+	options map[string]string
+	players int
+}{
+	{"default rules", nil, 3},
+	{"one player", nil, 1},
+	{"two players", nil, 2},
+	{"no peeking", map[string]string{PeekCount: "0"}, 4},
+	{"big hands and tag penalty", map[string]string{HandSize: "6", PeekCount: "6", TagPenalty: "3"}, 6},
+	{"no tag penalty", map[string]string{TagPenalty: "0", HandSize: "1", PeekCount: "1"}, 3},
+	{"jokers with a power", map[string]string{Jokers: "true", JokerPower: "lookSwap"}, 3},
+	{"every rank has a power", map[string]string{Powers: "2:swap,3:lookSwap,4:lookOther,5:lookOwn,6:swap,7:lookOwn,8:lookOwn,9:lookOther,T:lookOther,J:swap,Q:lookSwap,K:lookOther,A:swap"}, 4},
+	{"three decks", map[string]string{Decks: "3", Jokers: "true"}, 12},
+	{"assisted memory", map[string]string{AssistedMemory: "true"}, 3},
+}
+
+func testGame(t *testing.T, table int, seed int64) bungaGameState {
+	rules, err := parseRules(testTables[table].options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	players := []string{}
+	for i := 1; i <= testTables[table].players; i++ {
+		players = append(players, "p"+strconv.Itoa(i))
+	}
+	state, err := NewGame(rules, players, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broken := state.invariants(); len(broken) > 0 {
+		t.Fatalf("dealt a broken game: %v", broken)
+	}
+	return state
+}
+
+// Make up a move, usually from whoever's turn it is and about their own cards so games get somewhere,
+// but sometimes one that makes no sense at all
+func testMove(s bungaGameState, pick func(n int) int) userMsg {
+	player := s.Turn
+	if pick(3) == 0 {
+		player = s.PlayerOrder[pick(len(s.PlayerOrder))]
+	}
+	owner := player
+	if pick(2) == 0 {
+		owner = s.PlayerOrder[pick(len(s.PlayerOrder))]
+	}
+	// the odd index just past the end of the hand
+	index := strconv.Itoa(pick(len(s.PlayerHands[owner]) + 1))
+	args := map[string]string{Player: player}
+	switch pick(30) {
+	case 0:
+		return userMsg{Target: Timer, Cmd: Timeout, Args: map[string]string{Player: s.Turn}}
+	case 1:
+		return userMsg{Target: TargetGame, Cmd: Bunga, Args: args}
+	case 2:
+		return userMsg{Target: TargetGame, Cmd: "shuffle", Args: args}
+	case 3:
+		return userMsg{Target: TargetGame, Cmd: Card, Args: map[string]string{Player: "nobody", Owner: owner, Index: index}}
+	case 4, 5, 6, 7:
+		return userMsg{Target: TargetGame, Cmd: Draw, Args: args}
+	case 8, 9, 10, 11:
+		return userMsg{Target: TargetGame, Cmd: Discard, Args: args}
+	}
+	args[Owner] = owner
+	args[Index] = index
+	return userMsg{Target: TargetGame, Cmd: Card, Args: args}
+}
+
+// Apply a move and check it kept the invariants, and that the state it was given didn't change
+func testApply(t *testing.T, s bungaGameState, move userMsg) (bungaGameState, *gameError) {
+	before, _ := json.Marshal(s)
+	next, actions, err := Apply(s, move)
+	if after, _ := json.Marshal(s); string(before) != string(after) {
+		t.Fatalf("applying %s %v changed the state it was given", move.Cmd, move.Args)
+	}
+	if err != nil {
+		if actions != nil {
+			t.Fatalf("rejected %s %v with actions %v", move.Cmd, move.Args, actions)
+		}
+		return s, err
+	}
+	if broken := next.invariants(); len(broken) > 0 {
+		t.Fatalf("applying %s %v during %s %s broke: %v", move.Cmd, move.Args, s.GameState, s.PlayingState, broken)
+	}
+	return next, nil
+}
+
+// Play random moves through every set of house rules, checking the invariants after each one,
+// then replay the game's log and check it ends up the same
+func TestApplyKeepsInvariants(t *testing.T) {
+	games := 40
+	if testing.Short() {
+		games = 10
+	}
+	for table, tt := range testTables {
+		t.Run(tt.name, func(t *testing.T) {
+			finished := 0
+			for seed := int64(1); seed <= int64(games); seed++ {
+				rng := rand.New(rand.NewSource(seed))
+				state := testGame(t, table, seed)
+				log := newBungaLog(state)
+				for i := 0; i < 1000 && state.GameState != EndGame; i++ {
+					move := testMove(state, rng.Intn)
+					next, err := testApply(t, state, move)
+					log.Events = append(log.Events, bungaEvent{Msg: move, Accepted: err == nil, Error: err})
+					state = next
+				}
+				if state.GameState == EndGame {
+					finished++
+				}
+				var last interface{}
+				if err := replayBunga(&log, Spectators, func(view interface{}) bool {
+					last = view
+					return true
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(last, View(state, Spectators)) {
+					t.Fatalf("seed %d: replaying the log ended up somewhere else", seed)
+				}
+			}
+			if finished == 0 {
+				t.Errorf("none of the %d games finished", games)
+			}
+		})
+	}
+}
+
+// Knowledge never says a player knows a card they couldn't have worked out from their own views:
+// a memory bot watches each player's views, and has to remember every card the player is meant to know
+func TestKnowledgeMatchesViews(t *testing.T) {
+	for table, tt := range testTables {
+		t.Run(tt.name, func(t *testing.T) {
+			for seed := int64(1); seed <= 10; seed++ {
+				rng := rand.New(rand.NewSource(seed))
+				state := testGame(t, table, seed)
+				bots := map[string]*bot{}
+				for _, player := range state.PlayerOrder {
+					bots[player] = newBot(player, BotMemory, seed)
+				}
+				check := func() {
+					for _, player := range state.PlayerOrder {
+						bots[player].observe(View(state, player))
+						for _, owner := range state.PlayerOrder {
+							for idx, card := range state.PlayerHands[owner] {
+								if state.knows(player, owner, idx) && bots[player].known[owner][idx] != card {
+									t.Fatalf("seed %d: %q is meant to know %q's card %d is %q, but could only remember %q",
+										seed, player, owner, idx, card, bots[player].known[owner][idx])
+								}
+							}
+						}
+					}
+				}
+				check()
+				for i := 0; i < 1000 && state.GameState != EndGame; i++ {
+					// views only go out after a move's accepted, like in a lobby
+					var err *gameError
+					if state, err = testApply(t, state, testMove(state, rng.Intn)); err == nil && state.GameState != EndGame {
+						check()
+					}
+				}
+			}
+		})
+	}
+}
+
+// With assisted memory everyone is reminded of the cards they peeked at, and the reminders follow the cards when they're swapped
+func TestAssistedMemory(t *testing.T) {
+	if remembered := View(testGame(t, 0, 1), "p1").Remembered; remembered != nil {
+		t.Errorf("reminded of %v without assisted memory", remembered)
+	}
+	state := testGame(t, len(testTables)-1, 1)
+	dealt := map[string][]string{}
+	for _, player := range state.PlayerOrder {
+		dealt[player] = append([]string{}, state.PlayerHands[player]...)
+		var err *gameError
+		if state, err = testApply(t, state, userMsg{TargetGame, Card, map[string]string{Player: player, Owner: player, Index: "0"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(when string, viewer string, owner string, want ...string) {
+		if got := View(state, viewer).Remembered[owner]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s %s is reminded of %s's hand as %v, want %v", when, viewer, owner, got, want)
+		}
+	}
+	expect("after getting ready", "p1", "p1", dealt["p1"][0], dealt["p1"][1], "", "")
+	expect("after getting ready", "p1", "p2", "", "", "", "")
+	expect("after getting ready", "p2", "p2", dealt["p2"][0], dealt["p2"][1], "", "")
+
+	// p1 swaps their first card with p2's
+	state.PlayingState = SwapOtherChoice
+	for _, owner := range []string{"p2", "p1"} {
+		var err *gameError
+		if state, err = testApply(t, state, userMsg{TargetGame, Card, map[string]string{Player: "p1", Owner: owner, Index: "0"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect("after the swap", "p1", "p1", "", dealt["p1"][1], "", "")
+	expect("after the swap", "p1", "p2", dealt["p1"][0], "", "", "")
+	expect("after the swap", "p2", "p1", dealt["p2"][0], "", "", "")
+	expect("after the swap", "p2", "p2", "", dealt["p2"][1], "", "")
+}
+
+// A wrong tag with nothing left to pick up skips the penalty, and says so in the latest actions
+func TestSkippedPenalty(t *testing.T) {
+	state, _ := testApply(t, testGame(t, 0, 1), userMsg{Timer, Timeout, map[string]string{Player: ""}})
+	// one card left in each pile, p2 holds the rest
+	top := len(state.DrawPile) - 1
+	for _, card := range state.DrawPile[:top-1] {
+		state.addCard("p2", card, cardKnowledge{})
+	}
+	state.DiscardPile = append(state.DiscardPile, state.DrawPile[top-1])
+	state.DrawPile = state.DrawPile[top:]
+	idx := 0
+	for cardRank(state.PlayerHands["p2"][idx]) == cardRank(state.discardTop()) {
+		idx++
+	}
+	hand := len(state.PlayerHands["p2"])
+	state, err := testApply(t, state, userMsg{TargetGame, Card, map[string]string{Player: "p2", Owner: "p2", Index: strconv.Itoa(idx)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.PlayerHands["p2"]) != hand {
+		t.Errorf("p2 has %d cards after a skipped penalty, want %d", len(state.PlayerHands["p2"]), hand)
+	}
+	want := bungaAction{Start: Draw, End: Draw, Card: Wrong}
+	if last := state.LatestAction[len(state.LatestAction)-1]; last != want {
+		t.Errorf("latest action is %v, want %v", last, want)
+	}
+}
+
+// Moves that make no sense are rejected with the right code, and so is everything once the game's over
+func TestApplyRejects(t *testing.T) {
+	state := testGame(t, 0, 1)
+	for _, tt := range []struct {
+		name string
+		move userMsg
+		code string
+	}{
+		{"not playing", userMsg{TargetGame, Draw, map[string]string{Player: "nobody"}}, ErrNotPlayer},
+		{"unknown command", userMsg{TargetGame, "shuffle", map[string]string{Player: "p1"}}, ErrBadCommand},
+		{"unknown owner", userMsg{TargetGame, Card, map[string]string{Player: "p1", Owner: "nobody", Index: "0"}}, ErrBadArgs},
+		{"no such card", userMsg{TargetGame, Card, map[string]string{Player: "p1", Owner: "p1", Index: "4"}}, ErrBadArgs},
+		{"drawing before the game starts", userMsg{TargetGame, Draw, map[string]string{Player: "p1"}}, ErrIllegalMove},
+		{"getting ready with an unpeeked card", userMsg{TargetGame, Card, map[string]string{Player: "p1", Owner: "p1", Index: "3"}}, ErrIllegalMove},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testApply(t, state, tt.move)
+			if err == nil || err.Code != tt.code {
+				t.Errorf("got %v, want %s", err, tt.code)
+			}
+		})
+	}
+
+	// everyone runs out of time getting ready, then bunga goes round the table
+	state, _ = testApply(t, state, userMsg{Timer, Timeout, map[string]string{Player: ""}})
+	for state.GameState != EndGame {
+		move := userMsg{TargetGame, Bunga, map[string]string{Player: state.Turn}}
+		if state.SaidBunga != "" {
+			move = userMsg{Timer, Timeout, map[string]string{Player: state.Turn}}
+		}
+		var err *gameError
+		if state, err = testApply(t, state, move); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := testApply(t, state, userMsg{TargetGame, Draw, map[string]string{Player: state.Turn}}); err == nil || err.Code != ErrIllegalMove {
+		t.Errorf("got %v after the game's over, want %s", err, ErrIllegalMove)
+	}
+}
+
+// Feed the state machine whatever moves the fuzzer comes up with, the first byte picks the house rules
+// and every byte after that is a choice testMove makes
+func FuzzApply(f *testing.F) {
+	f.Add(int64(1), []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	f.Add(int64(2), []byte{4, 0, 0, 0, 9, 9, 9, 200, 13, 77, 5, 5, 5, 5})
+	f.Add(int64(3), []byte{7, 255, 128, 64, 32, 16, 8, 4, 2, 1, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})
+	f.Fuzz(func(t *testing.T, seed int64, choices []byte) {
+		if len(choices) == 0 {
+			return
+		}
+		table := int(choices[0]) % len(testTables)
+		choices = choices[1:]
+		pick := func(n int) int {
+			if len(choices) == 0 {
+				return 0
+			}
+			choice := int(choices[0]) % n
+			choices = choices[1:]
+			return choice
+		}
+		state := testGame(t, table, seed)
+		for len(choices) > 0 && state.GameState != EndGame {
+			state, _ = testApply(t, state, testMove(state, pick))
+		}
+	})
+}
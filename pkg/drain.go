@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long running games get to finish once the server starts draining,
+// for games that can't be saved and carried on after the restart
+var drainWindow = 2 * time.Minute
+
+// How much longer than the drain window to wait for lobbies to close their connections
+const drainSlack = 5 * time.Second
+
+// Whether the server is draining, so no new lobbies or connections are let in
+// protected by lobbiesLock
+var draining bool
+
+func isDraining() bool {
+	lobbiesLock.Lock()
+	defer lobbiesLock.Unlock()
+	return draining
+}
+
+// Put the server into drain mode:
+// - stop letting anyone in
+// - tell every lobby to wrap up, with the window for finishing games
+// - wait for the lobbies to close, or give up a little after the window runs out
+func drainLobbies(window time.Duration) {
+	lobbiesLock.Lock()
+	draining = true
+	open := []*lobby{}
+	for _, l := range lobbies {
+		open = append(open, l)
+	}
+	lobbiesLock.Unlock()
+
+	fmt.Println("Draining", len(open), "lobbies")
+	for _, l := range open {
+		l.drain <- window
+	}
+	deadline := time.Now().Add(window + drainSlack)
+	for {
+		lobbiesLock.Lock()
+		left := len(lobbies)
+		lobbiesLock.Unlock()
+		if left == 0 {
+			fmt.Println("All lobbies closed")
+			return
+		}
+		if time.Now().After(deadline) {
+			fmt.Println("Gave up waiting on", left, "lobbies")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Start closing the lobby for a server restart:
+// - a game that's saved to disk carries on after the restart, so close straight away
+// - so does a lobby with no game running
+// - otherwise tell everyone how long they've got, and close once the game ends or the window runs out
+func (l *lobby) startDrain(window time.Duration) <-chan time.Time {
+	l.draining = true
+	if l.g == nil || (stateDir != "" && l.gameType.restore != nil) {
+		l.notify("The server is restarting, you'll be reconnected once it's back")
+		l.shutdown()
+		return nil
+	}
+	l.notify(fmt.Sprintf("The server is restarting in %s, finish up your game", window))
+	return time.After(window)
+}
+
+// Send everyone in the lobby a notice from the server
+func (l *lobby) notify(text string) {
+	msg, _ := json.Marshal(lobbyMsg{TargetNotice, text})
+	l.userLock.Lock()
+	for _, u := range l.users {
+		u.send(msg)
+	}
+	l.userLock.Unlock()
+}
+
+// Close the lobby for a server restart:
+// - save it one last time, and keep the snapshot so it comes back after the restart
+// - stop the game
+// - close everyone's connection with a close frame saying the server's restarting, and wait for them to go out
+// - tell the manager the lobby's gone
+func (l *lobby) shutdown() {
+	fmt.Println("lobby shutting down", l.name)
+	l.saveSnapshot()
+	l.saveLock.Lock()
+	l.ended = true
+	l.saveLock.Unlock()
+	l.passToGame(userMsg{TargetGame, "quit", nil})
+	l.userLock.Lock()
+	users := l.users
+	for _, u := range users {
+		u.close(websocket.CloseServiceRestart, "server restarting")
+	}
+	l.users = map[string]*user{}
+	l.userLock.Unlock()
+	for _, u := range users {
+		u.waitClosed()
+	}
+	l.closed = true
+	l.done <- l.name
+}
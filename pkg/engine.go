@@ -0,0 +1,124 @@
+package main
+
+import "fmt"
+
+// The bunga engine is the rules on their own, with no channels, clocks or lobby:
+// - NewGame deals a game
+// - Apply makes a move, returning the next state and leaving the one it was given alone
+// - View is what a player or spectator sees of a state
+// The same state and move always give the same result, so games can be replayed, simulated and tested
+
+// Deal a game to the players, who take their turns in the given order
+// the seed decides every shuffle, and 0 decks in the rules picks enough for the number of players
+func NewGame(rules bungaRules, players []string, seed int64) (bungaGameState, error) {
+	if len(players) == 0 {
+		return bungaGameState{}, fmt.Errorf("no one to deal to")
+	}
+	seen := map[string]struct{}{}
+	for _, player := range players {
+		if _, ok := seen[player]; ok {
+			return bungaGameState{}, fmt.Errorf("%q can't be dealt in twice", player)
+		}
+		seen[player] = struct{}{}
+	}
+	if rules.Decks == 0 {
+		rules.Decks = rules.decksFor(len(players))
+	}
+	if len(players) > rules.maxPlayers() {
+		return bungaGameState{}, fmt.Errorf("%d decks with a %d card hand only have room for %d players", rules.Decks, rules.HandSize, rules.maxPlayers())
+	}
+	s := bungaGameState{
+		DiscardPile: []string{},
+		Knowledge:   map[string][]cardKnowledge{},
+		GameState:   StartGame,
+		PlayerOrder: append([]string{}, players...),
+		Seed:        seed,
+		Rules:       rules,
+	}
+	s.initDeckCards()
+	s.Turn = s.PlayerOrder[0]
+	s.initPlayerHands()
+	s.PlayersReady = map[string]string{}
+	for _, player := range s.PlayerOrder {
+		s.PlayersReady[player] = ""
+	}
+	s.initKnowledge()
+	return s, nil
+}
+
+// Make a move, from a player or the turn clock, and return the state after it along with what it did
+// A rejected move returns the state it was given
+func Apply(state bungaGameState, move userMsg) (bungaGameState, []bungaAction, *gameError) {
+	if state.GameState == EndGame {
+		return state, nil, &gameError{ErrIllegalMove, "the game's over"}
+	}
+	s := state.clone()
+	s.LatestAction = []bungaAction{}
+	var err *gameError
+	if move.Target == Timer {
+		// the turn clock ran out, this didn't come from a user
+		err = s.timeout(move)
+	} else {
+		err = s.validateMove(move)
+		if err == nil && s.GameState == StartGame {
+			err = s.moveStartgameState(move)
+		} else if err == nil && s.GameState == Playing {
+			err = s.movePlayingState(move)
+		}
+	}
+	if err != nil {
+		return state, nil, err
+	}
+	s.topUpDrawPile()
+	if s.GameState == EndGame {
+		s.computeScores()
+		s.revealAll()
+	}
+	return s, append([]bungaAction{}, s.LatestAction...), nil
+}
+
+// What a player sees of the game, anyone who isn't playing gets the spectator view
+// and once it's over everyone gets the final one. The turn clock isn't part of the state, so TimeLeft is 0
+func View(state bungaGameState, player string) bungaUserState {
+	views := state.getUserStates()
+	if state.GameState == EndGame {
+		return views[Final]
+	}
+	if view, ok := views[player]; ok {
+		return view
+	}
+	return views[Spectators]
+}
+
+// A copy of the state that shares nothing a move can change
+func (s bungaGameState) clone() bungaGameState {
+	s.DrawPile = append([]string{}, s.DrawPile...)
+	s.DiscardPile = append([]string{}, s.DiscardPile...)
+	s.LatestAction = append([]bungaAction{}, s.LatestAction...)
+	s.PlayerOrder = append([]string{}, s.PlayerOrder...)
+	ready := map[string]string{}
+	for player, status := range s.PlayersReady {
+		ready[player] = status
+	}
+	s.PlayersReady = ready
+	hands := map[string][]string{}
+	for player, hand := range s.PlayerHands {
+		hands[player] = append([]string{}, hand...)
+	}
+	s.PlayerHands = hands
+	knowledge := map[string][]cardKnowledge{}
+	for owner, cards := range s.Knowledge {
+		for _, k := range cards {
+			knowledge[owner] = append(knowledge[owner], k.clone())
+		}
+	}
+	s.Knowledge = knowledge
+	if s.Scores != nil {
+		scores := map[string]int{}
+		for player, score := range s.Scores {
+			scores[player] = score
+		}
+		s.Scores = scores
+	}
+	return s
+}
@@ -1,11 +1,121 @@
 package main
 
+import "sort"
+
 type game interface {
 	runGame()
 	broadcastState()
 }
 
+// Sent by the lobby to a game to have it send everyone their views again
+const gameResync = "resync"
+
+// Sent by the lobby to a game when a player's left the lobby for good, with their id as the player arg
+// the game carries on without them
+const gameLeave = "leave"
+
 type gameMsg struct {
 	player string
 	state  interface{}
 }
+
+// Error codes sent back with a rejected command
+const (
+	ErrBadCommand  string = "badCommand"
+	ErrBadArgs     string = "badArgs"
+	ErrNotPlayer   string = "notPlayer"
+	ErrNotYourTurn string = "notYourTurn"
+	ErrIllegalMove string = "illegalMove"
+	ErrNotHost     string = "notHost"
+	ErrLobbyFull   string = "lobbyFull"
+	ErrBadVersion  string = "badVersion"
+)
+
+// An error sent back only to the user whose command caused it, as a lobbyMsg with target error
+type gameError struct {
+	Code    string
+	Message string
+}
+
+func (e *gameError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Sent by a game whenever its state changes, so the lobby can save it for restoring after a restart
+type gameSnapshot []byte
+
+// Sent by a game when a player stops or starts taking their turns, so the lobby can show them as away
+type awayNotice struct {
+	Player string
+	Away   bool
+}
+
+// An option a game accepts through the startGame args
+type gameOption struct {
+	Name        string
+	Description string
+	Default     string
+}
+
+// Metadata for a game type, sent to clients so they can pick one
+// DefaultPlayers is the player cap for lobbies that don't ask for one, MaxPlayers the most the game can take
+type gameInfo struct {
+	Name           string
+	MinPlayers     int
+	MaxPlayers     int
+	DefaultPlayers int
+	Options        []gameOption
+}
+
+// A game type has:
+// - metadata
+// - a constructor, given the lobby state, the startGame args and the game channels
+// - a scoring hook for reading per-player scores out of a finished game
+// - an event log hook, for keeping the game's history once it's over
+// - a replay function, calling step with a player's view at each point of an event log
+// - a restore function, for carrying on a game from the last snapshot it sent, nil if it can't
+// - the commands players send it, and the type of the view it sends them, for documenting the protocol
+// Replay stops early if step returns false
+type gameType struct {
+	info     gameInfo
+	create   func(l *lobbyState, args map[string]string, in chan userMsg, out chan gameMsg) (game, error)
+	scores   func(g game) map[string]int
+	eventLog func(g game) interface{}
+	replay   func(eventLog interface{}, player string, step func(view interface{}) bool) error
+	restore  func(l *lobbyState, snapshot []byte, in chan userMsg, out chan gameMsg) (game, error)
+	commands []commandSpec
+	view     interface{}
+}
+
+const defaultGame = "bunga"
+
+var gameTypes = map[string]gameType{}
+
+// Games register themselves from an init function in their own file
+func registerGame(t gameType) {
+	if _, ok := gameTypes[t.info.Name]; ok {
+		panic("game registered twice: " + t.info.Name)
+	}
+	gameTypes[t.info.Name] = t
+}
+
+// Look up a game type by name, an empty name gives the default game
+func lookupGame(name string) (gameType, bool) {
+	if name == "" {
+		name = defaultGame
+	}
+	t, ok := gameTypes[name]
+	return t, ok
+}
+
+// Metadata for every registered game, sorted by name
+func gameInfos() []gameInfo {
+	ret := []gameInfo{}
+	for _, t := range gameTypes {
+		ret = append(ret, t.info)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
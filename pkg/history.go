@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxGameRecords = 200
+const maxReplayDelay = 5 * time.Second
+
+// A finished game has:
+// - an id, given out in the lobby state as LastGame
+// - the lobby it was played in
+// - the name of the game type, for finding its replay function
+// - the game's event log
+type gameRecord struct {
+	Id    string
+	Lobby string
+	Game  string
+	Log   interface{}
+}
+
+type replayStep struct {
+	Step int
+	View interface{}
+}
+
+// Finished games are kept in memory, oldest dropped first once there's too many
+var gameRecords map[string]*gameRecord
+var gameRecordOrder []string
+var gameRecordCount int
+var gameRecordsLock sync.Mutex
+
+// Keep a finished game's event log, returning the id it can be fetched with
+func addGameRecord(lobbyName string, t gameType, g game) string {
+	gameRecordsLock.Lock()
+	defer gameRecordsLock.Unlock()
+	gameRecordCount++
+	id := fmt.Sprintf("%s-%d", lobbyName, gameRecordCount)
+	gameRecords[id] = &gameRecord{
+		Id:    id,
+		Lobby: lobbyName,
+		Game:  t.info.Name,
+		Log:   t.eventLog(g),
+	}
+	gameRecordOrder = append(gameRecordOrder, id)
+	if len(gameRecordOrder) > maxGameRecords {
+		delete(gameRecords, gameRecordOrder[0])
+		gameRecordOrder = gameRecordOrder[1:]
+	}
+	return id
+}
+
+func getGameRecord(id string) (*gameRecord, bool) {
+	gameRecordsLock.Lock()
+	defer gameRecordsLock.Unlock()
+	rec, ok := gameRecords[id]
+	return rec, ok
+}
+
+// Returns a finished game's event log as json
+func handleGameLog(w http.ResponseWriter, r *http.Request) {
+	rec, ok := getGameRecord(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "Unknown game", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// Streams a replay of a finished game as one json view per line, as seen by the given player
+// Optionally waits delay milliseconds between steps, so it can be watched as it comes in
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	rec, ok := getGameRecord(query.Get("id"))
+	if !ok {
+		http.Error(w, "Unknown game", http.StatusNotFound)
+		return
+	}
+	t, ok := lookupGame(rec.Game)
+	if !ok {
+		http.Error(w, "Unknown game type", http.StatusNotFound)
+		return
+	}
+	delay := time.Duration(0)
+	if query.Get("delay") != "" {
+		ms, err := strconv.Atoi(query.Get("delay"))
+		if err != nil || ms < 0 {
+			http.Error(w, "Invalid delay", http.StatusBadRequest)
+			return
+		}
+		delay = time.Duration(ms) * time.Millisecond
+		if delay > maxReplayDelay {
+			delay = maxReplayDelay
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	step := 0
+	err := t.replay(rec.Log, query.Get("player"), func(view interface{}) bool {
+		if step > 0 && delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return false
+			}
+		}
+		if err := enc.Encode(replayStep{step, view}); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		step++
+		return true
+	})
+	if err != nil && step == 0 {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Whether every move a game accepts is checked against the invariants, with anything broken logged
+// it's slow, so it's off unless turned on with CHECKINVARIANTS
+var checkInvariants bool
+
+// The playing states where the player whose turn it is has picked a card
+var selectionStates = map[string]struct{}{
+	LookingOwn:         {},
+	LookingOther:       {},
+	SwapOtherOwnChoice: {},
+	LookSwapOwnChoice:  {},
+}
+
+// Check the rules every game state has to keep, whatever moves got it there:
+// - every card of the deck is somewhere, exactly once for each deck shuffled in
+// - everyone in the player order has a hand, a ready status and a score once it's over, and the turn is one of theirs
+// - a card is only picked while a look or swap power is being used, and it's a card that's there
+// - every card has knowledge, and it's face up for exactly the players the rules let see it
+// - nobody's view shows or reminds them of a card they don't know or aren't allowed to see, and every card it does show is the real one
+// Returns what's broken, if anything
+func (s bungaGameState) invariants() []string {
+	ret := s.cardInvariants()
+	ret = append(ret, s.playerInvariants()...)
+	ret = append(ret, s.knowledgeInvariants()...)
+	ret = append(ret, s.viewInvariants()...)
+	return ret
+}
+
+func (s bungaGameState) cardInvariants() []string {
+	ret := []string{}
+	counts := map[string]int{}
+	for _, card := range newDeck(s.Rules) {
+		counts[card]++
+	}
+	inPlay := map[string]int{}
+	piles := [][]string{s.DrawPile, s.DiscardPile}
+	for _, player := range s.PlayerOrder {
+		piles = append(piles, s.PlayerHands[player])
+	}
+	for _, pile := range piles {
+		for _, card := range pile {
+			inPlay[card]++
+		}
+	}
+	cards := []string{}
+	for card := range counts {
+		cards = append(cards, card)
+	}
+	for card := range inPlay {
+		if _, ok := counts[card]; !ok {
+			cards = append(cards, card)
+		}
+	}
+	sort.Strings(cards)
+	for _, card := range cards {
+		if inPlay[card] != counts[card] {
+			ret = append(ret, fmt.Sprintf("%q is in play %d times, the deck has %d", card, inPlay[card], counts[card]))
+		}
+	}
+	if len(s.DrawPile) == 0 && s.GameState != EndGame {
+		ret = append(ret, "the draw pile is empty")
+	}
+	return ret
+}
+
+func (s bungaGameState) playerInvariants() []string {
+	ret := []string{}
+	if len(s.PlayerHands) != len(s.PlayerOrder) || len(s.PlayersReady) != len(s.PlayerOrder) {
+		ret = append(ret, fmt.Sprintf("%d players, but %d hands and %d ready statuses", len(s.PlayerOrder), len(s.PlayerHands), len(s.PlayersReady)))
+	}
+	for _, player := range s.PlayerOrder {
+		if len(s.PlayerHands[player]) == 0 {
+			ret = append(ret, fmt.Sprintf("%q has no cards", player))
+		}
+		if s.GameState != StartGame && s.PlayersReady[player] != Ready {
+			ret = append(ret, fmt.Sprintf("%q isn't ready during %s", player, s.GameState))
+		}
+		if _, ok := s.Scores[player]; s.GameState == EndGame && !ok {
+			ret = append(ret, fmt.Sprintf("%q has no score", player))
+		}
+	}
+	if !containsId(s.PlayerOrder, s.Turn) {
+		ret = append(ret, fmt.Sprintf("it's %q's turn, but they aren't playing", s.Turn))
+	}
+	if s.SaidBunga != "" && !containsId(s.PlayerOrder, s.SaidBunga) {
+		ret = append(ret, fmt.Sprintf("%q said bunga, but they aren't playing", s.SaidBunga))
+	}
+	_, choosing := selectionStates[s.PlayingState]
+	choosing = choosing && s.GameState == Playing
+	if choosing && s.SelectedOwner == "" {
+		ret = append(ret, "no card picked during "+s.PlayingState)
+	}
+	if !choosing && s.SelectedOwner != "" {
+		ret = append(ret, fmt.Sprintf("%q's card %d is picked during %s", s.SelectedOwner, s.SelectedIdx, s.PlayingState))
+	}
+	if s.SelectedOwner != "" && (s.SelectedIdx < 0 || s.SelectedIdx >= len(s.PlayerHands[s.SelectedOwner])) {
+		ret = append(ret, fmt.Sprintf("%q's card %d is picked, but they don't have it", s.SelectedOwner, s.SelectedIdx))
+	}
+	return ret
+}
+
+// Whether a player is allowed to see a card in someone's hand, going by the rules rather than by how views are made:
+// - before the game starts, the cards everyone peeks at in their own hand until they're ready
+// - the card the player whose turn it is picked to look at
+// - every card once the game's over
+func (s bungaGameState) mayKnow(viewer string, owner string, idx int) bool {
+	switch s.GameState {
+	case StartGame:
+		return viewer == owner && s.PlayersReady[viewer] == "" && idx < s.Rules.PeekCount
+	case Playing:
+		if viewer != s.Turn || !s.isSelected(owner, idx) {
+			return false
+		}
+		switch s.PlayingState {
+		case LookingOwn:
+			return owner == viewer
+		case LookingOther, LookSwapOwnChoice:
+			return owner != viewer
+		}
+		return false
+	}
+	return true
+}
+
+func (s bungaGameState) knowledgeInvariants() []string {
+	ret := []string{}
+	if len(s.Knowledge[Draw]) != 1 {
+		ret = append(ret, fmt.Sprintf("the draw pile has knowledge of %d cards", len(s.Knowledge[Draw])))
+	}
+	for _, owner := range s.PlayerOrder {
+		if len(s.Knowledge[owner]) != len(s.PlayerHands[owner]) {
+			ret = append(ret, fmt.Sprintf("%q has %d cards, but knowledge of %d", owner, len(s.PlayerHands[owner]), len(s.Knowledge[owner])))
+			continue
+		}
+		for i, k := range s.Knowledge[owner] {
+			for _, viewer := range k.ShownTo {
+				if !containsId(k.KnownTo, viewer) {
+					ret = append(ret, fmt.Sprintf("%q's card %d is face up for %q, who doesn't know it", owner, i, viewer))
+				}
+			}
+			for _, viewer := range s.PlayerOrder {
+				if shown := containsId(k.ShownTo, viewer); shown != s.mayKnow(viewer, owner, i) {
+					ret = append(ret, fmt.Sprintf("%q's card %d being face up for %q is %t during %s %s", owner, i, viewer, shown, s.GameState, s.PlayingState))
+				}
+			}
+		}
+	}
+	for _, viewer := range s.PlayerOrder {
+		drawing := viewer == s.Turn && s.GameState == Playing && s.PlayingState == DrawChoice
+		if s.shownTo(viewer, Draw, 0) != drawing {
+			ret = append(ret, fmt.Sprintf("the top of the draw pile being face up for %q is %t during %s %s", viewer, !drawing, s.GameState, s.PlayingState))
+		}
+	}
+	return ret
+}
+
+func (s bungaGameState) viewInvariants() []string {
+	ret := []string{}
+	views := s.getUserStates()
+	viewers := append(append([]string{}, s.PlayerOrder...), Spectators)
+	if s.GameState == EndGame {
+		viewers = []string{Final}
+	}
+	for _, viewer := range viewers {
+		view, ok := views[viewer]
+		if !ok {
+			ret = append(ret, fmt.Sprintf("%q has no view", viewer))
+			continue
+		}
+		if view.Remembered != nil && !s.Rules.AssistedMemory {
+			ret = append(ret, fmt.Sprintf("%q is reminded of cards without assisted memory", viewer))
+		}
+		for _, owner := range s.PlayerOrder {
+			for i, card := range view.Remembered[owner] {
+				if card == "" {
+					continue
+				}
+				if i >= len(s.PlayerHands[owner]) || card != s.PlayerHands[owner][i] || !s.knows(viewer, owner, i) {
+					ret = append(ret, fmt.Sprintf("%q is reminded %q is %q's card %d without having seen it there", viewer, card, owner, i))
+				}
+			}
+			hand := view.PlayerHands[owner]
+			if len(hand) != len(s.PlayerHands[owner]) {
+				ret = append(ret, fmt.Sprintf("%q sees %d cards in %q's hand, they have %d", viewer, len(hand), owner, len(s.PlayerHands[owner])))
+				continue
+			}
+			for i, card := range hand {
+				face := cardFace(card)
+				if face == Back {
+					continue
+				}
+				if face != s.PlayerHands[owner][i] {
+					ret = append(ret, fmt.Sprintf("%q sees %q as %q's card %d, it's %q", viewer, face, owner, i, s.PlayerHands[owner][i]))
+				}
+				if viewer != Final && !s.mayKnow(viewer, owner, i) {
+					ret = append(ret, fmt.Sprintf("%q can see %q's card %d during %s %s", viewer, owner, i, s.GameState, s.PlayingState))
+				}
+				if viewer != Final && !s.knows(viewer, owner, i) {
+					ret = append(ret, fmt.Sprintf("%q can see %q's card %d without knowing it", viewer, owner, i))
+				}
+			}
+		}
+		if face := cardFace(view.DrawPile); face != Back {
+			top := ""
+			if len(s.DrawPile) > 0 {
+				top = s.drawTop()
+			}
+			if face != top {
+				ret = append(ret, fmt.Sprintf("%q sees %q on the draw pile, it's %q", viewer, face, top))
+			}
+			if viewer != s.Turn || s.GameState != Playing || s.PlayingState != DrawChoice {
+				ret = append(ret, fmt.Sprintf("%q can see the top of the draw pile during %s %s", viewer, s.GameState, s.PlayingState))
+			}
+			if !s.knows(viewer, Draw, 0) {
+				ret = append(ret, fmt.Sprintf("%q can see the top of the draw pile without knowing it", viewer))
+			}
+		}
+		if face := cardFace(view.DiscardPile); face != s.discardTop() {
+			ret = append(ret, fmt.Sprintf("%q sees %q on the discard pile, it's %q", viewer, face, s.discardTop()))
+		}
+	}
+	return ret
+}
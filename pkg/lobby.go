@@ -4,12 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
-const maxLobbySize = 2
-
 // target: either lobby or game
 // cmd: specific command, e.g. 'kick', 'changeHost', 'move'
 // args: details for what to do with the command
@@ -25,11 +24,26 @@ type lobbyMsg struct {
 }
 
 type lobbyState struct {
-	Status  string
-	Players []string
-	Scores  map[string]int
+	Status     string
+	Players    []string
+	Spectators []string
+	Host       string
+	MaxPlayers int
+	Scores     map[string]int
+	Game       string
+	Games      []gameInfo
+	LastGame   string
+	Away       map[string]int64 // when a disconnected user loses their seat, 0 for players who stopped taking turns
+	Match      *matchState
+	Latency    map[string]int // round trip time to each connected user, in milliseconds
 }
 
+// How long a disconnected user keeps their seat before they're removed from the lobby
+var reconnectGrace = 60 * time.Second
+
+// How much someone's latency has to change by before everyone's told, in milliseconds
+const latencyStep = 10
+
 // A lobby has:
 // - status (playing or lobby)
 // - game object pointer
@@ -37,134 +51,584 @@ type lobbyState struct {
 // - mutex for protecting list of users
 // - done channel for signalling main to destroy lobby
 // - webToLobby channel for passing to users
+// - session tokens, so only the same person can reconnect as a user
+// - awayExpired channel, for hearing when a disconnected user's grace period is up
+// - userLatency channel, for hearing how long users' pings take
+// - userResumed channel, for hearing how users' resumes went
+// - joins channel, for users who've connected and are waiting to be added
+// - the start game arguments for the match being played, and a channel for dealing its rounds
+// - the levels of any bots, and the game's latest snapshot, for saving the lobby
+// - mutex for saving, and whether the lobby has ended and shouldn't be saved any more
+// - drain channel, for hearing the server's restarting, whether it's draining, and whether it's closed for good
+// - stopped channel, closed once the lobby's routine has returned, so nothing waits on it forever
 type lobby struct {
-	name        string
-	state       lobbyState
-	g           game
-	users       map[string]*user
-	userLock    sync.Mutex
-	done        chan string
-	webToLobby  chan []byte
-	lobbyToGame chan userMsg
-	gameToLobby chan gameMsg
-	userEndConn chan string
+	name         string
+	state        lobbyState
+	g            game
+	gameType     gameType
+	users        map[string]*user
+	userLock     sync.Mutex
+	done         chan string
+	webToLobby   chan webMsg
+	lobbyToGame  chan userMsg
+	gameToLobby  chan gameMsg
+	userEndConn  chan *user
+	awayExpired  chan *user
+	userLatency  chan latencyReport
+	userResumed  chan resumeReport
+	joins        chan joinReq
+	sessions     map[string]string
+	matchArgs    map[string]string
+	roundReady   chan matchRound
+	bots         map[string]string
+	gameSnapshot []byte
+	saveLock     sync.Mutex
+	ended        bool
+	drain        chan time.Duration
+	draining     bool
+	closed       bool
+	stopped      chan struct{}
 }
 
 func (l *lobby) broadcastState() {
 	fmt.Println("Broadcasting state")
-	msg, _ := json.Marshal(lobbyMsg{"lobby", l.state})
+	msg, _ := json.Marshal(lobbyMsg{TargetLobby, l.state})
 	l.userLock.Lock()
 	for u := range l.users {
-		l.users[u].lobbyToWeb <- msg
+		l.users[u].send(msg)
 	}
 	l.userLock.Unlock()
+	l.saveSnapshot()
 }
 
-// Add user function:
-// - set user's webToLobby channel
-// - lock mutex
-// - add user to list
-// - release mutex
-func (l *lobby) addUser(u *user) {
-	// if the user id is already in the lobby it's probably a reload, so clear the old connection
-	if _, ok := l.users[u.id]; ok {
-		l.removeUser(u.id)
-	}
+// A user who's connected and is waiting to be added to the lobby, on the team they asked for
+type joinReq struct {
+	u    *user
+	team string
+}
+
+// Point a user's channels at the lobby, before anything starts sending on them
+func (l *lobby) wireUser(u *user) {
 	u.webToLobby = l.webToLobby
 	u.endConn = l.userEndConn
+	u.latency = l.userLatency
+	u.resumed = l.userResumed
+}
+
+// Hand a connected user to the lobby's routine to add, since only it changes the lobby state
+// if the lobby's already stopped, their connection's closed
+func (l *lobby) join(u *user, team string) {
+	select {
+	case l.joins <- joinReq{u, team}:
+	case <-l.stopped:
+		close(u.quit)
+	}
+}
+
+// Add user function, called by the lobby routine on a user whose channels are wired up:
+// - lock mutex
+// - if the user id is already in the lobby it's a reconnect, so swap in the new connection and keep their seat
+// - otherwise add user to list, on the requested team, and give them a session token
+// - anyone joining while a game is running or once the lobby is full becomes a spectator
+// - the first person to join becomes host
+// - release mutex
+// - send the user their session token, then everyone the full state
+func (l *lobby) addUser(u *user, team string) {
 	l.userLock.Lock()
-	l.users[u.id] = u
-	l.state.Players = append(l.state.Players, u.id)
-	l.state.Scores[u.id] = 0
+	if old, ok := l.users[u.id]; ok {
+		fmt.Println("lobby reconnecting", u.id)
+		close(old.quit)
+		// numbering carries on from the old connection, so the client can resume
+		u.out = old.out
+		l.users[u.id] = u
+		delete(l.state.Away, u.id)
+	} else {
+		if l.g != nil || l.full() {
+			team = Spectators
+		}
+		l.users[u.id] = u
+		if team == Spectators {
+			l.state.Spectators = append(l.state.Spectators, u.id)
+		} else {
+			l.state.Players = append(l.state.Players, u.id)
+		}
+		l.state.Scores[u.id] = 0
+		if l.state.Host == "" && !u.isBot {
+			l.state.Host = u.id
+		}
+		if !u.isBot {
+			l.sessions[u.id] = newToken()
+		}
+	}
+	token := l.sessions[u.id]
 	l.userLock.Unlock()
+	if !u.isBot {
+		msg, _ := json.Marshal(lobbyMsg{TargetSession, token})
+		u.send(msg)
+	}
 	l.broadcastState()
-	if l.g != nil {
-		go l.g.broadcastState()
+	l.resyncGame()
+}
+
+// Remove a user and tell everyone, and the game if they had a seat in it
+func (l *lobby) removeUser(id string) {
+	seated := l.g != nil && containsId(l.state.Players, id)
+	l.dropUser(id)
+	l.broadcastState()
+	if seated {
+		l.passToGame(userMsg{Target: TargetLobby, Cmd: gameLeave, Args: map[string]string{"player": id}})
 	}
 }
 
-// Remove user function:
+// Drop user function, callers broadcast the change:
 // - lock mutex
 // - remove user from list
+// - if they were host, pass host on to the next person
 // - release mutex
-func (l *lobby) removeUser(id string) {
+func (l *lobby) dropUser(id string) {
 	l.userLock.Lock()
-	idx := 0
-	for i, player := range l.state.Players {
-		if player == id {
-			idx = i
-		}
-	}
-	l.state.Players = append(l.state.Players[:idx], l.state.Players[idx+1:]...)
+	l.state.Players = removeId(l.state.Players, id)
+	l.state.Spectators = removeId(l.state.Spectators, id)
 	delete(l.state.Scores, id)
+	delete(l.state.Away, id)
+	delete(l.state.Latency, id)
+	delete(l.sessions, id)
+	delete(l.bots, id)
+	if u, ok := l.users[id]; ok {
+		close(u.quit)
+	}
 	delete(l.users, id)
+	if l.state.Host == id {
+		l.state.Host = l.nextHost()
+	}
+	l.userLock.Unlock()
+}
+
+// Whether someone may join as the given user id, taken ids need that user's session token
+func (l *lobby) canJoin(id string, token string) bool {
+	l.userLock.Lock()
+	defer l.userLock.Unlock()
+	u, ok := l.users[id]
+	if !ok {
+		return true
+	}
+	return !u.isBot && token != "" && token == l.sessions[id]
+}
+
+// Mark a disconnected user as away, they keep their seat until the grace period is up
+func (l *lobby) markAway(u *user) {
+	if reconnectGrace <= 0 {
+		l.removeUser(u.id)
+		return
+	}
+	l.setAway(u)
+	l.broadcastState()
+	l.resyncGame()
+}
+
+// Start a disconnected user's grace period, they lose their seat if they're not back by the end of it
+// callers broadcast the change
+func (l *lobby) setAway(u *user) {
+	fmt.Println("lobby marking", u.id, "away")
+	l.userLock.Lock()
+	l.state.Away[u.id] = time.Now().Add(reconnectGrace).Unix()
+	delete(l.state.Latency, u.id)
+	l.userLock.Unlock()
+	time.AfterFunc(reconnectGrace, func() {
+		// a reconnect or removal closes quit, then there's nothing left to expire
+		select {
+		case l.awayExpired <- u:
+		case <-u.quit:
+		}
+	})
+}
+
+// Show a player who keeps timing out as away, with no deadline since they're still connected
+// someone who's disconnected stays away until they reconnect
+func (l *lobby) handleAwayNotice(notice awayNotice) {
+	l.userLock.Lock()
+	deadline, away := l.state.Away[notice.Player]
+	if notice.Away && !away {
+		l.state.Away[notice.Player] = 0
+	} else if !notice.Away && away && deadline == 0 {
+		delete(l.state.Away, notice.Player)
+	}
 	l.userLock.Unlock()
 	l.broadcastState()
 }
 
+// Keep track of how long a user's pings take, and tell everyone once it's changed enough to notice
+func (l *lobby) handleLatency(report latencyReport) {
+	if l.users[report.u.id] != report.u {
+		return
+	}
+	ms := int(report.rtt.Milliseconds())
+	l.userLock.Lock()
+	last, ok := l.state.Latency[report.u.id]
+	changed := !ok || ms-last >= latencyStep || last-ms >= latencyStep
+	if changed {
+		l.state.Latency[report.u.id] = ms
+	}
+	l.userLock.Unlock()
+	if changed {
+		l.broadcastState()
+	}
+}
+
+// Pick a new host, players first then spectators, never a bot
+// callers hold userLock
+func (l *lobby) nextHost() string {
+	for _, ids := range [][]string{l.state.Players, l.state.Spectators} {
+		for _, id := range ids {
+			if !l.users[id].isBot {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+func removeId(ids []string, id string) []string {
+	for i, other := range ids {
+		if other == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+func containsId(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Move a user between players and spectators, only allowed while no game is running
+func (l *lobby) handleChangeTeam(id string, args map[string]string) *gameError {
+	if l.g != nil {
+		return &gameError{ErrIllegalMove, "can't change teams during a game"}
+	}
+	l.userLock.Lock()
+	defer l.userLock.Unlock()
+	switch {
+	case args["team"] == Spectators && containsId(l.state.Players, id):
+		l.state.Players = removeId(l.state.Players, id)
+		l.state.Spectators = append(l.state.Spectators, id)
+	case args["team"] == Players && containsId(l.state.Spectators, id):
+		if l.full() {
+			return &gameError{ErrLobbyFull, "the lobby is full"}
+		}
+		l.state.Spectators = removeId(l.state.Spectators, id)
+		l.state.Players = append(l.state.Players, id)
+	case args["team"] == Players && containsId(l.state.Players, id),
+		args["team"] == Spectators && containsId(l.state.Spectators, id):
+		return &gameError{ErrIllegalMove, id + " is already on team " + strconv.Quote(args["team"])}
+	default:
+		return &gameError{ErrBadArgs, "unknown team " + strconv.Quote(args["team"])}
+	}
+	return nil
+}
+
+// Send an error to just the one user
+func (l *lobby) sendError(id string, err *gameError) {
+	if u, ok := l.users[id]; ok {
+		msg, _ := json.Marshal(lobbyMsg{TargetError, err})
+		u.send(msg)
+	}
+}
+
+// Number of users that aren't bots, the lobby ends once they've all left
+func (l *lobby) humanCount() int {
+	count := 0
+	for _, u := range l.users {
+		if !u.isBot {
+			count++
+		}
+	}
+	return count
+}
+
+// Add a bot player with the given difficulty, named after the first free bot number
+func (l *lobby) handleAddBot(args map[string]string) *gameError {
+	level := args["level"]
+	if level == "" {
+		level = BotRandom
+	}
+	if _, ok := botLevels[level]; !ok {
+		return &gameError{ErrBadArgs, "unknown bot level " + strconv.Quote(level)}
+	}
+	if l.full() {
+		return &gameError{ErrLobbyFull, "the lobby is full"}
+	}
+	id := ""
+	for i := 1; id == ""; i++ {
+		name := "bot " + strconv.Itoa(i)
+		if _, ok := l.users[name]; !ok {
+			id = name
+		}
+	}
+	u := createUser(id)
+	u.isBot = true
+	l.wireUser(&u)
+	l.userLock.Lock()
+	l.bots[id] = level
+	l.userLock.Unlock()
+	go newBot(id, level, time.Now().UnixNano()).run(&u)
+	l.addUser(&u, Players)
+	return nil
+}
+
+// Remove someone from the lobby, players can only be kicked between games
+func (l *lobby) handleKick(args map[string]string) *gameError {
+	id := args["player"]
+	if _, ok := l.users[id]; !ok || id == l.state.Host {
+		return &gameError{ErrBadArgs, "can't kick " + strconv.Quote(id)}
+	}
+	if l.g != nil && containsId(l.state.Players, id) {
+		return &gameError{ErrIllegalMove, "can't kick " + id + " during a game"}
+	}
+	fmt.Println("lobby kicking", id)
+	l.removeUser(id)
+	return nil
+}
+
+func (l *lobby) handleChangeHost(args map[string]string) *gameError {
+	u, ok := l.users[args["player"]]
+	if !ok || u.isBot {
+		return &gameError{ErrBadArgs, "can't make " + strconv.Quote(args["player"]) + " host"}
+	}
+	l.state.Host = u.id
+	return nil
+}
+
+// The player cap for lobbies that don't ask for one, the default for the default game type
+func defaultMaxPlayers() int {
+	t, _ := lookupGame(defaultGame)
+	return t.info.DefaultPlayers
+}
+
+// The highest player cap a lobby can ask for, enough for any game type
+func largestMaxPlayers() int {
+	ret := 0
+	for _, info := range gameInfos() {
+		if info.MaxPlayers > ret {
+			ret = info.MaxPlayers
+		}
+	}
+	return ret
+}
+
+// Whether the lobby has no room for more players, callers hold userLock
+func (l *lobby) full() bool {
+	return len(l.state.Players) >= l.state.MaxPlayers
+}
+
 // Lobby creation involves:
 // - setting name
 // - setting status
+// - setting the player cap
 // - creating list of users
 // - initializing mutex to protect user list
-func createLobby(name string, done chan string) lobby {
+func createLobby(name string, done chan string, maxPlayers int) lobby {
 	return lobby{
 		name: name,
 		state: lobbyState{
-			Status:  "lobby",
-			Players: make([]string, 0),
-			Scores:  make(map[string]int),
+			Status:     "lobby",
+			Players:    make([]string, 0),
+			Spectators: make([]string, 0),
+			MaxPlayers: maxPlayers,
+			Scores:     make(map[string]int),
+			Game:       defaultGame,
+			Games:      gameInfos(),
+			Away:       make(map[string]int64),
+			Latency:    make(map[string]int),
 		},
 		users:       make(map[string]*user),
 		done:        done,
-		webToLobby:  make(chan []byte),
+		webToLobby:  make(chan webMsg),
 		gameToLobby: make(chan gameMsg),
-		userEndConn: make(chan string),
+		userEndConn: make(chan *user),
+		awayExpired: make(chan *user),
+		userLatency: make(chan latencyReport),
+		userResumed: make(chan resumeReport),
+		joins:       make(chan joinReq),
+		sessions:    make(map[string]string),
+		roundReady:  make(chan matchRound),
+		bots:        make(map[string]string),
+		drain:       make(chan time.Duration),
+		stopped:     make(chan struct{}),
 	}
 }
 
-func (l *lobby) handleStartGame() {
-	fmt.Println("lobby starting game")
-	l.gameToLobby = make(chan gameMsg)
-	l.lobbyToGame = make(chan userMsg)
-	l.g = createBunga(&l.state, l.lobbyToGame, l.gameToLobby)
+// Start a game, or the first round of a match if the host set one up
+func (l *lobby) handleStartGame(args map[string]string) *gameError {
+	if l.g != nil {
+		return &gameError{ErrIllegalMove, "a game is already running"}
+	}
+	if l.draining {
+		return &gameError{ErrIllegalMove, "the server is restarting"}
+	}
+	match, err := newMatch(args, l.state.Players)
+	if err != nil {
+		return err
+	}
+	if match == nil {
+		l.state.Match = nil
+		return l.startGame(args)
+	}
+	// later rounds reuse the settings, but each gets a fresh deal
+	l.matchArgs = map[string]string{}
+	for k, v := range args {
+		if k != Seed {
+			l.matchArgs[k] = v
+		}
+	}
+	previous := l.state.Match
+	l.state.Match = match
+	if err := l.startRound(args); err != nil {
+		l.state.Match = previous
+		return err
+	}
+	return nil
+}
+
+func (l *lobby) startGame(args map[string]string) *gameError {
+	t, ok := lookupGame(args["game"])
+	if !ok {
+		return &gameError{ErrBadArgs, "unknown game " + strconv.Quote(args["game"])}
+	}
+	if len(l.state.Players) < t.info.MinPlayers || len(l.state.Players) > t.info.MaxPlayers {
+		return &gameError{ErrIllegalMove, fmt.Sprintf("%s needs %d to %d players", t.info.Name, t.info.MinPlayers, t.info.MaxPlayers)}
+	}
+	fmt.Println("lobby starting game", t.info.Name)
+	lobbyToGame := make(chan userMsg)
+	gameToLobby := make(chan gameMsg)
+	g, err := t.create(&l.state, args, lobbyToGame, gameToLobby)
+	if err != nil {
+		return &gameError{ErrBadArgs, err.Error()}
+	}
+	l.lobbyToGame = lobbyToGame
+	l.gameToLobby = gameToLobby
+	l.gameType = t
+	l.g = g
+	l.state.Game = t.info.Name
 	l.state.Status = "game"
 	fmt.Println("lobby running game")
 	go l.g.runGame()
+	return nil
 }
 
 func (l *lobby) handleQuitGame() {
-	// add scores to lobby state
-	bunga, _ := l.g.(*bunga)
-	if bunga != nil {
-		for player, score := range bunga.state.Scores {
+	// add scores to lobby state, and keep the game's event log
+	if l.g != nil {
+		scores := l.gameType.scores(l.g)
+		for player, score := range scores {
 			l.state.Scores[player] += score
 		}
+		// a game that was quit early has no scores, so it doesn't count as a round
+		if l.state.Match != nil && !l.state.Match.Over && len(scores) > 0 {
+			l.state.Match.addRound(scores)
+		}
+		l.state.LastGame = addGameRecord(l.name, l.gameType, l.g)
 	}
 	// sort players by scores, ascending
 	sort.Slice(l.state.Players, func(i, j int) bool {
 		return l.state.Scores[l.state.Players[i]] < l.state.Scores[l.state.Players[j]]
 	})
 	l.g = nil
+	l.gameSnapshot = nil
 	l.lobbyToGame = nil
 	l.gameToLobby = nil
 }
 
-// TODO: handle error cases here
-func (l *lobby) handleCommand(msg *userMsg) {
+// Run a lobby command, a rejected command is sent back to the user as an error
+// and leaves the lobby state as it was
+func (l *lobby) handleCommand(id string, msg *userMsg) {
 	fmt.Println("Got gommand:", msg)
 	fmt.Println("Target:", msg.Target, "Cmd:", msg.Cmd, "Args:", msg.Args)
+	spec, ok := lookupCommand(lobbyCommands, msg.Cmd)
+	if !ok {
+		l.sendError(id, &gameError{ErrBadCommand, "unknown lobby command " + strconv.Quote(msg.Cmd)})
+		return
+	}
+	if spec.HostOnly && id != l.state.Host {
+		l.sendError(id, &gameError{ErrNotHost, "only " + l.state.Host + " can " + msg.Cmd})
+		return
+	}
+	if err := spec.check(msg.Args); err != nil {
+		l.sendError(id, err)
+		return
+	}
+	var err *gameError
 	switch msg.Cmd {
 	case "startGame":
-		l.handleStartGame()
+		err = l.handleStartGame(msg.Args)
 
 	case "quitGame":
-		l.lobbyToGame <- userMsg{"quit", "", nil}
-		l.handleQuitGame()
+		if l.g != nil {
+			l.passToGame(userMsg{"quit", "", nil})
+			l.handleQuitGame()
+		}
+		// quitting ends the match too, whoever's ahead wins it
+		if l.state.Match != nil && !l.state.Match.Over {
+			l.state.Match.finish()
+		}
 
 	case "backToLobby":
 		l.state.Status = "lobby"
 
+	case "resync":
+		// the lobby state goes out below, the game's views need asking for
+		// a user who's been removed can still have one queued up, so drop theirs
+		u, ok := l.users[id]
+		if !ok {
+			return
+		}
+		u.out.resync()
+		l.resyncGame()
+
+	case "resume":
+		// the web writer resends what was missed and reports back, if it can't the user gets fresh views
+		// a user who's been removed can still have one queued up, so drop theirs
+		u, ok := l.users[id]
+		if !ok {
+			return
+		}
+		seq, _ := strconv.Atoi(msg.Args["seq"])
+		if !u.resumeFrom(seq) {
+			u.out.resync()
+			l.resyncGame()
+		}
+
+	case "nextRound":
+		if l.state.Match != nil {
+			err = l.handleNextRound(matchRound{l.state.Match, len(l.state.Match.Results)})
+		} else {
+			err = &gameError{ErrIllegalMove, "no match is being played"}
+		}
+
+	case "addBot":
+		err = l.handleAddBot(msg.Args)
+
+	case "kick":
+		err = l.handleKick(msg.Args)
+
+	case "changeHost":
+		err = l.handleChangeHost(msg.Args)
+
+	case "changeTeam":
+		err = l.handleChangeTeam(id, msg.Args)
+
+	default:
+		err = &gameError{ErrBadCommand, "unknown lobby command " + strconv.Quote(msg.Cmd)}
+	}
+	if err != nil {
+		fmt.Println("lobby rejected command:", err)
+		l.sendError(id, err)
+		return
 	}
 
 	fmt.Println("Finished running command, broadcasting state")
@@ -172,8 +636,12 @@ func (l *lobby) handleCommand(msg *userMsg) {
 }
 
 func (l *lobby) endLobby() {
+	if l.ended {
+		return
+	}
+	l.removeSnapshot()
 	l.done <- l.name
-	l.lobbyToGame <- userMsg{"game", "quit", nil}
+	l.passToGame(userMsg{TargetGame, "quit", nil})
 }
 
 // The main lobby routine:
@@ -193,52 +661,162 @@ func (l *lobby) endLobby() {
 // - if game sends user input, pass it to user
 // - if game sends 'other' input, pass it to all users that aren't players
 // - if game sends final state, deinitialize game and set status to lobby
+// - if the server's draining, close once the game's finished or saved, or the drain window runs out
 func (l *lobby) runLobby() {
 	watchdog := time.NewTicker(1 * time.Minute)
+	defer watchdog.Stop()
+	defer close(l.stopped)
+	var drainTimeout <-chan time.Time
 
 	fmt.Println("running lobby", l.name)
-	for {
+	for !l.closed {
 		select {
 		case <-watchdog.C:
-			if len(l.users) == 0 {
+			if l.humanCount() == 0 {
 				l.endLobby()
 			}
 		case userEnded := <-l.userEndConn:
-			l.removeUser(userEnded)
-			if len(l.users) == 0 {
+			// a reload replaces the user, so only mark them away if it's still the same connection
+			if l.users[userEnded.id] == userEnded {
+				l.markAway(userEnded)
+			}
+			if l.humanCount() == 0 {
+				l.endLobby()
+			}
+		case req := <-l.joins:
+			l.addUser(req.u, req.team)
+		case report := <-l.userLatency:
+			l.handleLatency(report)
+		case report := <-l.userResumed:
+			// too much was missed, and the client's dropped its views, so everything needs sending in full
+			if !report.ok && l.users[report.u.id] == report.u {
+				l.broadcastState()
+				l.resyncGame()
+			}
+		case userExpired := <-l.awayExpired:
+			if l.users[userExpired.id] == userExpired {
+				fmt.Println("lobby removing", userExpired.id, "after grace period")
+				l.removeUser(userExpired.id)
+			}
+			if l.humanCount() == 0 {
 				l.endLobby()
 			}
 		case msgFromUser := <-l.webToLobby:
 			var msg userMsg
-			if err := json.Unmarshal(msgFromUser, &msg); err != nil {
+			if err := json.Unmarshal(msgFromUser.data, &msg); err != nil {
 				fmt.Println("user msg error", err)
+				l.sendError(msgFromUser.user, &gameError{ErrBadCommand, "couldn't read message: " + err.Error()})
+				continue
 			}
-			if msg.Target == "lobby" {
-				l.handleCommand(&msg)
-			} else if msg.Target == "game" {
-				fmt.Println("lobby passing user message to game")
-				if l.g != nil {
-					l.lobbyToGame <- msg
+			if msg.Target == TargetHello {
+				l.handleHello(msgFromUser.user, &msg)
+			} else if msg.Target == TargetLobby {
+				l.handleCommand(msgFromUser.user, &msg)
+			} else if msg.Target == TargetGame {
+				// only players can play, and only as themselves
+				if !containsId(l.state.Players, msgFromUser.user) {
+					l.sendError(msgFromUser.user, &gameError{ErrNotPlayer, "spectators can't play"})
+					continue
 				}
-				fmt.Println("lobby finished passing user message to game")
-			}
-		case msgFromGame := <-l.gameToLobby:
-			msg, _ := json.Marshal(lobbyMsg{"game", msgFromGame.state})
-			if msgFromGame.player == "final" || msgFromGame.player == "" {
-				fmt.Println("sending message from game to all players")
-				for u := range l.users {
-					l.users[u].lobbyToWeb <- msg
+				if l.g == nil {
+					l.sendError(msgFromUser.user, &gameError{ErrIllegalMove, "no game is running"})
+					continue
 				}
-				if msgFromGame.player == "final" {
-					fmt.Println("game finished, got final output")
-					l.handleQuitGame()
+				spec, ok := lookupCommand(l.gameType.commands, msg.Cmd)
+				if !ok {
+					l.sendError(msgFromUser.user, &gameError{ErrBadCommand, "unknown game command " + strconv.Quote(msg.Cmd)})
+					continue
 				}
-			} else {
-				fmt.Println("sending message from game to", msgFromGame.player)
-				if l.users[msgFromGame.player] != nil {
-					l.users[msgFromGame.player].lobbyToWeb <- msg
+				if err := spec.check(msg.Args); err != nil {
+					l.sendError(msgFromUser.user, err)
+					continue
+				}
+				if msg.Args == nil {
+					msg.Args = map[string]string{}
 				}
+				msg.Args["player"] = msgFromUser.user
+				fmt.Println("lobby passing user message to game")
+				l.passToGame(msg)
+				fmt.Println("lobby finished passing user message to game")
+			} else {
+				l.sendError(msgFromUser.user, &gameError{ErrBadCommand, "unknown target " + strconv.Quote(msg.Target)})
 			}
+		case msgFromGame := <-l.gameToLobby:
+			l.handleGameMsg(msgFromGame)
+		case next := <-l.roundReady:
+			if err := l.handleNextRound(next); err == nil {
+				l.broadcastState()
+			}
+		case window := <-l.drain:
+			drainTimeout = l.startDrain(window)
+		case <-drainTimeout:
+			l.shutdown()
+		}
+		// a draining lobby closes as soon as its game is over
+		if l.draining && l.g == nil && !l.closed {
+			l.shutdown()
+		}
+	}
+}
+
+// Have the game send everyone its views again, for users who lost track of them
+func (l *lobby) resyncGame() {
+	l.passToGame(userMsg{Target: TargetLobby, Cmd: gameResync})
+}
+
+// Pass a message to the game, forwarding the game's output while waiting
+// so the lobby and game can't block on sending to each other
+func (l *lobby) passToGame(msg userMsg) {
+	for l.g != nil {
+		select {
+		case l.lobbyToGame <- msg:
+			return
+		case msgFromGame := <-l.gameToLobby:
+			l.handleGameMsg(msgFromGame)
+		}
+	}
+}
+
+func (l *lobby) handleGameMsg(msgFromGame gameMsg) {
+	if err, ok := msgFromGame.state.(*gameError); ok {
+		l.sendError(msgFromGame.player, err)
+		return
+	}
+	if snap, ok := msgFromGame.state.(gameSnapshot); ok {
+		l.userLock.Lock()
+		l.gameSnapshot = snap
+		l.userLock.Unlock()
+		l.saveSnapshot()
+		return
+	}
+	if notice, ok := msgFromGame.state.(awayNotice); ok {
+		l.handleAwayNotice(notice)
+		return
+	}
+	msg, _ := json.Marshal(lobbyMsg{TargetGame, msgFromGame.state})
+	if msgFromGame.player == Spectators {
+		fmt.Println("sending message from game to spectators")
+		for _, id := range l.state.Spectators {
+			l.users[id].send(msg)
+		}
+	} else if msgFromGame.player == "final" || msgFromGame.player == "" {
+		fmt.Println("sending message from game to all players")
+		for u := range l.users {
+			l.users[u].send(msg)
+		}
+		if msgFromGame.player == "final" {
+			fmt.Println("game finished, got final output")
+			l.handleQuitGame()
+			if l.state.Match != nil && !l.state.Match.Over && !l.draining {
+				l.scheduleRound()
+			}
+			l.broadcastState()
+		}
+	} else {
+		fmt.Println("sending message from game to", msgFromGame.player)
+		// someone who took the name of a player that lost their seat only gets to spectate
+		if u, ok := l.users[msgFromGame.player]; ok && containsId(l.state.Players, msgFromGame.player) {
+			u.send(msg)
 		}
 	}
 }
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"text/template"
+	"time"
 )
 
 type HomeData struct {
@@ -17,6 +21,15 @@ type LobbyForm struct {
 }
 
 const listenPortEnv string = "LISTENPORT"
+const reconnectGraceEnv string = "RECONNECTGRACE"
+const stateDirEnv string = "STATEDIR"
+const drainWindowEnv string = "DRAINWINDOW"
+const pingIntervalEnv string = "PINGINTERVAL"
+const pongTimeoutEnv string = "PONGTIMEOUT"
+const checkInvariantsEnv string = "CHECKINVARIANTS"
+
+// How long open requests get to finish once every lobby has closed
+const shutdownTimeout = 10 * time.Second
 
 func handleHome(w http.ResponseWriter, r *http.Request) {
 	tmpl := template.Must(template.ParseFiles("templates/home.html"))
@@ -25,14 +38,57 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	// bunga sim plays bot games against each other without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "sim" {
+		os.Exit(runSim(os.Args[2:]))
+	}
+
 	fs := http.FileServer(http.Dir("./assets"))
 	http.Handle("/assets/", http.StripPrefix("/assets/", fs))
 	http.HandleFunc("/", handleHome)
 
-	managerInit()
-
+	// every setting's read before restoring lobbies, since they run with them straight away
+	stateDir = os.Getenv(stateDirEnv)
+	checkInvariants = os.Getenv(checkInvariantsEnv) != ""
 	port := os.Getenv(listenPortEnv)
+	if grace, err := time.ParseDuration(os.Getenv(reconnectGraceEnv)); err == nil {
+		reconnectGrace = grace
+	}
+	if window, err := time.ParseDuration(os.Getenv(drainWindowEnv)); err == nil {
+		drainWindow = window
+	}
+	if interval, err := time.ParseDuration(os.Getenv(pingIntervalEnv)); err == nil {
+		pingInterval = interval
+	}
+	if timeout, err := time.ParseDuration(os.Getenv(pongTimeoutEnv)); err == nil {
+		pongTimeout = timeout
+	}
+	if pingInterval > 0 && pongTimeout <= pingInterval {
+		fmt.Println("pong timeout has to be longer than the ping interval, using", 2*pingInterval)
+		pongTimeout = 2 * pingInterval
+	}
+	managerInit()
 
 	fmt.Println("Starting server")
-	http.ListenAndServe(":"+port, nil)
+	srv := &http.Server{Addr: ":" + port}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Println("server error:", err)
+			os.Exit(1)
+		}
+	}()
+
+	// on SIGTERM, drain the lobbies before shutting down
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	fmt.Println("Draining server")
+	drainLobbies(drainWindow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Println("shutdown error:", err)
+	}
+	fmt.Println("Server stopped")
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -13,6 +14,13 @@ type NewLobbyResp struct {
 	Name string `json:"name"`
 }
 
+type ValidResp struct {
+	Players    int  `json:"players"`
+	MaxPlayers int  `json:"maxPlayers"`
+	Full       bool `json:"full"`
+	NameTaken  bool `json:"nameTaken"`
+}
+
 // Main has:
 // - map from lobby names to lobbies
 // - mutex for lobby map
@@ -37,26 +45,63 @@ func removeLobby(name string) {
 }
 
 // Join lobby connection handler:
-// - if the lobby doesn't exist, create it, and add it to map
-// - create the user object
-// - add the user to the lobby user list
+// - if the server is draining, turn everyone away until it's back
+// - if the lobby doesn't exist, create it with the requested player cap, and add it to map
+// - if the user id is taken, only let them in with that user's session token, it's a reconnect
+// - if the lobby is full, refuse users asking to join as players, and make anyone else a spectator
+// - create the user object, wired up to the lobby
 // - start the lobby runner function
 // - start the user handler function to make it start listening
+// - hand the user to the lobby to add to its user list
 func handleJoinLobby(w http.ResponseWriter, r *http.Request) {
 	lobbyName := r.URL.Query()["lobby"][0]
 	userId := r.URL.Query()["user"][0]
+	team := r.URL.Query().Get("team")
+	token := r.URL.Query().Get("token")
 
 	fmt.Println("Join request from", userId, "for lobby", lobbyName)
 
+	if isDraining() {
+		http.Error(w, "Server is restarting", http.StatusServiceUnavailable)
+		return
+	}
 	if _, ok := lobbies[lobbyName]; !ok {
+		maxPlayers := defaultMaxPlayers()
+		if r.URL.Query().Get("maxPlayers") != "" {
+			var err error
+			maxPlayers, err = strconv.Atoi(r.URL.Query().Get("maxPlayers"))
+			if err != nil || maxPlayers < 1 || maxPlayers > largestMaxPlayers() {
+				http.Error(w, "Invalid player cap", http.StatusBadRequest)
+				return
+			}
+		}
 		fmt.Println("Creating lobby", lobbyName)
-		l := createLobby(lobbyName, lobbyDone)
+		l := createLobby(lobbyName, lobbyDone, maxPlayers)
 		addLobby(&l)
 		go l.runLobby()
 	}
+	l := lobbies[lobbyName]
+	if !l.canJoin(userId, token) {
+		http.Error(w, "Name is taken", http.StatusConflict)
+		return
+	}
+	l.userLock.Lock()
+	_, rejoining := l.users[userId]
+	full := l.full()
+	l.userLock.Unlock()
+	if full && team == Players && !rejoining {
+		http.Error(w, "Lobby is full", http.StatusConflict)
+		return
+	}
+	if full {
+		team = Spectators
+	}
 	u := createUser(userId)
-	u.runUser(w, r)
-	lobbies[lobbyName].addUser(&u)
+	l.wireUser(&u)
+	if err := u.runUser(w, r); err != nil {
+		return
+	}
+	l.join(&u, team)
 }
 
 // Lobby cleanup goroutine:
@@ -79,17 +124,28 @@ func handleValid(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Received validation request:", f)
 
 	// validate the lobby exists
-	if _, ok := lobbies[f.Lobby]; !ok {
+	l, ok := lobbies[f.Lobby]
+	if !ok {
 		http.Error(w, "Invalid lobby", http.StatusBadRequest)
 		return
 	}
 
-	// implicitly return 200 status ok
+	// report how full the lobby is, so the home screen can warn before connecting
+	l.userLock.Lock()
+	_, taken := l.users[f.Name]
+	resp, _ := json.Marshal(ValidResp{
+		Players:    len(l.state.Players),
+		MaxPlayers: l.state.MaxPlayers,
+		Full:       l.full(),
+		NameTaken:  taken,
+	})
+	l.userLock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
 }
 
 func randName() string {
 	letters := []byte("abcdefghjkmnopqrstuvwxyz")
-	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(letters), func(i, j int) {
 		letters[i], letters[j] = letters[j], letters[i]
 	})
@@ -97,7 +153,12 @@ func randName() string {
 }
 
 // Don't actually create a lobby, just generate a lobby code that's 4 random letters
+// no new lobbies while the server is draining
 func handleNewLobby(w http.ResponseWriter, r *http.Request) {
+	if isDraining() {
+		http.Error(w, "Server is restarting", http.StatusServiceUnavailable)
+		return
+	}
 	for {
 		name := randName()
 		if _, ok := lobbies[name]; !ok {
@@ -113,13 +174,20 @@ func handleNewLobby(w http.ResponseWriter, r *http.Request) {
 // - initializes lobby map
 // - initializes lobby done
 // - starts the lobby cleanup goroutine
+// - restores any lobbies saved before a restart
 // - sets up handler join lobby
 func managerInit() {
+	rand.Seed(time.Now().UnixNano())
 	lobbies = make(map[string]*lobby)
 	lobbyDone = make(chan string)
+	gameRecords = make(map[string]*gameRecord)
 	go lobbyCleanup()
+	restoreLobbies()
 
 	http.HandleFunc("/joinLobby", handleJoinLobby)
 	http.HandleFunc("/valid", handleValid)
 	http.HandleFunc("/newLobby", handleNewLobby)
+	http.HandleFunc("/gameLog", handleGameLog)
+	http.HandleFunc("/replay", handleReplay)
+	http.HandleFunc("/protocol", handleProtocol)
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Start game arguments for playing a match instead of a single game
+const (
+	MatchRounds string = "rounds"
+	MatchTarget string = "target"
+)
+
+// How long everyone gets to look at the final hands before the next round is dealt
+const nextRoundDelay = 15 * time.Second
+
+// A match has:
+// - the players it started with, who take turns going first
+// - how it ends, after a number of rounds or once someone's total reaches the target
+// - the scores from each round played so far
+// - running totals for the match
+// - when the next round gets dealt, as a unix time, 0 if no round is waiting
+// - whether it's over, and who won with the lowest total
+type matchState struct {
+	Players   []string
+	Rounds    int
+	Target    int
+	Results   []map[string]int
+	Totals    map[string]int
+	NextRound int64
+	Over      bool
+	Winner    string
+}
+
+// Read the match settings out of the start game arguments, no settings means no match
+func newMatch(args map[string]string, players []string) (*matchState, *gameError) {
+	if args[MatchRounds] == "" && args[MatchTarget] == "" {
+		return nil, nil
+	}
+	m := &matchState{
+		Players: append([]string{}, players...),
+		Results: []map[string]int{},
+		Totals:  map[string]int{},
+	}
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{{MatchRounds, &m.Rounds}, {MatchTarget, &m.Target}} {
+		if args[setting.name] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(args[setting.name])
+		if err != nil || n < 1 {
+			return nil, &gameError{ErrBadArgs, fmt.Sprintf("invalid match %s %q", setting.name, args[setting.name])}
+		}
+		*setting.value = n
+	}
+	for _, player := range players {
+		m.Totals[player] = 0
+	}
+	return m, nil
+}
+
+// Who goes first in the next round, moving one seat along each round
+// and skipping anyone who's left the lobby
+func (m *matchState) firstPlayer(present []string) string {
+	for i := range m.Players {
+		player := m.Players[(len(m.Results)+i)%len(m.Players)]
+		if containsId(present, player) {
+			return player
+		}
+	}
+	return ""
+}
+
+// Add a finished round's scores, and end the match if that was the last one
+func (m *matchState) addRound(scores map[string]int) {
+	round := map[string]int{}
+	for player, score := range scores {
+		round[player] = score
+		m.Totals[player] += score
+	}
+	m.Results = append(m.Results, round)
+	if m.Rounds > 0 && len(m.Results) >= m.Rounds {
+		m.finish()
+	}
+	for _, total := range m.Totals {
+		if m.Target > 0 && total >= m.Target {
+			m.finish()
+		}
+	}
+}
+
+// End the match, lowest total wins
+func (m *matchState) finish() {
+	m.Over = true
+	m.NextRound = 0
+	m.Winner = ""
+	for _, player := range m.Players {
+		if m.Winner == "" || m.Totals[player] < m.Totals[m.Winner] {
+			m.Winner = player
+		}
+	}
+}
+
+// A round that's waiting to be dealt, told apart by its match and how many rounds came before
+// so a stale timer from an earlier round or a different match doesn't deal twice
+type matchRound struct {
+	match *matchState
+	round int
+}
+
+// Deal the next round of the match once everyone's had a look at the last one
+func (l *lobby) scheduleRound() {
+	m := l.state.Match
+	m.NextRound = time.Now().Add(nextRoundDelay).Unix()
+	next := matchRound{m, len(m.Results)}
+	time.AfterFunc(nextRoundDelay, func() {
+		select {
+		case l.roundReady <- next:
+		case <-l.stopped:
+		}
+	})
+}
+
+// Start the next round of the match, if it's still the one waiting
+func (l *lobby) handleNextRound(next matchRound) *gameError {
+	m := l.state.Match
+	if l.g != nil || m == nil || m != next.match || m.NextRound == 0 || len(m.Results) != next.round {
+		return &gameError{ErrIllegalMove, "no round is waiting to be dealt"}
+	}
+	if l.draining {
+		return &gameError{ErrIllegalMove, "the server is restarting"}
+	}
+	m.NextRound = 0
+	l.state.Status = "game"
+	if err := l.startRound(l.matchArgs); err != nil {
+		// someone left and there's not enough players for another round
+		fmt.Println("lobby ending match early:", err)
+		m.finish()
+		l.state.Status = "lobby"
+	}
+	return nil
+}
+
+// Start a game for the current round of the match, with the given player going first
+func (l *lobby) startRound(args map[string]string) *gameError {
+	roundArgs := map[string]string{}
+	for k, v := range args {
+		roundArgs[k] = v
+	}
+	roundArgs[First] = l.state.Match.firstPlayer(l.state.Players)
+	return l.startGame(roundArgs)
+}
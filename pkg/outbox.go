@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// How many recent messages are kept for each user, for resending what a reconnecting client missed
+const resendBuffer = 256
+
+// A message as it's sent to a user:
+// - the target, like any other message
+// - its place in the order of everything sent to them, which carries on across reconnects
+// - the state, or for users who asked for patches and a lobby or game view,
+// a JSON merge patch (RFC 7396) against the view sent with the base sequence number
+type sentMsg struct {
+	Target string
+	Seq    int
+	Base   int             `json:",omitempty"`
+	State  json.RawMessage `json:",omitempty"`
+	Patch  json.RawMessage `json:",omitempty"`
+}
+
+// The answer to a resume, sent once everything missed has been resent
+// if too much was missed to resend, the client gets fresh views instead, and should drop what it had
+type resumeEvent struct {
+	From  int
+	Reset bool
+}
+
+// Everything sent to a user, handed over to their new connection when they reconnect:
+// - the sequence number of the last message
+// - the last messages sent, by sequence number, in a ring
+// - whether they asked for patches, whether the next views should be sent in full, and what patches are made against
+// Only the user's web writer sends messages, so the order messages are numbered in is the order they're written
+type outbox struct {
+	lock       sync.Mutex
+	seq        int
+	recent     [][]byte
+	patches    bool
+	resyncNext bool
+	sent       viewTracker
+}
+
+// How a resume went, false if too much was missed and the user needs fresh views
+type resumeReport struct {
+	u  *user
+	ok bool
+}
+
+func newOutbox() *outbox {
+	return &outbox{recent: make([][]byte, resendBuffer)}
+}
+
+// Switch over to patches, from the next message on
+func (o *outbox) startPatches() {
+	o.lock.Lock()
+	o.patches = true
+	o.lock.Unlock()
+}
+
+// Have the next view of each target sent in full, for a client that's lost track
+func (o *outbox) resync() {
+	o.lock.Lock()
+	o.resyncNext = true
+	o.lock.Unlock()
+}
+
+// Number a message, keep it for resending, and turn it into what's sent
+// Returns nil if there's nothing new to send
+func (o *outbox) next(message []byte) []byte {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var out sentMsg
+	if err := json.Unmarshal(message, &out); err != nil {
+		fmt.Println("couldn't read outgoing message:", err)
+		return message
+	}
+	seq := o.seq + 1
+	if o.patches && !o.patch(&out, seq) {
+		return nil
+	}
+	o.seq = seq
+	out.Seq = seq
+	ret, _ := json.Marshal(out)
+	o.recent[seq%resendBuffer] = ret
+	return ret
+}
+
+// The messages sent after the given sequence number, false if some of them are gone from the ring
+func (o *outbox) since(from int) ([][]byte, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if from < 0 || from > o.seq || o.seq-from > resendBuffer-1 {
+		return nil, false
+	}
+	ret := [][]byte{}
+	for seq := from + 1; seq <= o.seq; seq++ {
+		ret = append(ret, o.recent[seq%resendBuffer])
+	}
+	return ret, true
+}
+
+// Hand the web writer a resume without waiting for the resending, it reports back on the resumed channel
+// false if there's no writer to take it, bots and users with no connection can't resume
+func (u *user) resumeFrom(from int) bool {
+	if u.c == nil {
+		return false
+	}
+	select {
+	case u.resume <- from:
+		return true
+	case <-u.quit:
+		return false
+	}
+}
+
+// Resend what the user missed, then tell them and the lobby how it went, called by the web writer
+// if too much was missed, the next views go out in full
+func (u *user) handleResume(from int) {
+	missed, ok := u.out.since(from)
+	if !ok {
+		u.out.resync()
+	}
+	for _, message := range missed {
+		u.write(message)
+	}
+	event, _ := json.Marshal(lobbyMsg{TargetResume, resumeEvent{from, !ok}})
+	u.write(u.out.next(event))
+	// the lobby could be waiting to send to this writer, so don't hold the writer up reporting back
+	go func() {
+		select {
+		case u.resumed <- resumeReport{u, ok}:
+		case <-u.quit:
+		}
+	}()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// The views patches are made against, everything else is always sent in full
+var patchedTargets = map[string]struct{}{
+	TargetLobby: {},
+	TargetGame:  {},
+}
+
+// What a user who asked for patches was last sent:
+// - the last view sent for each target, and the sequence number it was sent with
+type viewTracker struct {
+	views map[string]interface{}
+	bases map[string]int
+}
+
+// Turn a view into a patch against the last one sent for its target, if that's smaller
+// callers hold the outbox lock, and seq is the number the message is about to be sent with
+// Returns false if nothing's changed since the last view and there's nothing to send
+func (o *outbox) patch(out *sentMsg, seq int) bool {
+	if _, ok := patchedTargets[out.Target]; !ok {
+		return true
+	}
+	if o.resyncNext || o.sent.views == nil {
+		o.resyncNext = false
+		o.sent.views = map[string]interface{}{}
+		o.sent.bases = map[string]int{}
+	}
+	var view interface{}
+	json.Unmarshal(out.State, &view)
+	if last, ok := o.sent.views[out.Target]; ok {
+		patch, changed := mergePatch(last, view)
+		if !changed {
+			return false
+		}
+		// a patch that's bigger than the view isn't worth sending
+		if data, _ := json.Marshal(patch); len(data) < len(out.State) {
+			out.Base = o.sent.bases[out.Target]
+			out.State = nil
+			out.Patch = data
+		}
+	}
+	o.sent.views[out.Target] = view
+	o.sent.bases[out.Target] = seq
+	return true
+}
+
+// Make a JSON merge patch that turns old into new, and say whether they're any different
+// a null and a missing member are the same thing in a merge patch
+func mergePatch(old, new interface{}) (interface{}, bool) {
+	oldObj, oldOk := old.(map[string]interface{})
+	newObj, newOk := new.(map[string]interface{})
+	if !oldOk || !newOk {
+		if reflect.DeepEqual(old, new) {
+			return nil, false
+		}
+		return new, true
+	}
+	patch := map[string]interface{}{}
+	for key, value := range newObj {
+		if value == nil {
+			if oldObj[key] != nil {
+				patch[key] = nil
+			}
+			continue
+		}
+		if sub, changed := mergePatch(oldObj[key], value); changed {
+			patch[key] = sub
+		}
+	}
+	for key, value := range oldObj {
+		if _, ok := newObj[key]; !ok && value != nil {
+			patch[key] = nil
+		}
+	}
+	return patch, len(patch) > 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Apply a JSON merge patch the way a client does
+func applyMergePatch(old, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	oldObj, ok := old.(map[string]interface{})
+	ret := map[string]interface{}{}
+	if ok {
+		for key, value := range oldObj {
+			ret[key] = value
+		}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(ret, key)
+		} else {
+			ret[key] = applyMergePatch(ret[key], value)
+		}
+	}
+	return ret
+}
+
+func decodeJSON(t *testing.T, data string) interface{} {
+	var ret interface{}
+	if err := json.Unmarshal([]byte(data), &ret); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// Patches hold only what changed, and applying one to the old view gives the new one
+func TestMergePatch(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		old     string
+		new     string
+		patch   string
+		changed bool
+	}{
+		{"add", `{"Host":"a"}`, `{"Host":"a","Status":"lobby"}`, `{"Status":"lobby"}`, true},
+		{"remove", `{"Host":"a","Status":"lobby"}`, `{"Host":"a"}`, `{"Status":null}`, true},
+		{"null is missing", `{"Host":"a","Match":null}`, `{"Host":"a"}`, `{}`, false},
+		{"nested", `{"Scores":{"a":1,"b":2}}`, `{"Scores":{"a":1,"b":3}}`, `{"Scores":{"b":3}}`, true},
+		{"array", `{"Players":["a","b"]}`, `{"Players":["b"]}`, `{"Players":["b"]}`, true},
+		{"unchanged", `{"Players":["a"],"Scores":{"a":1}}`, `{"Players":["a"],"Scores":{"a":1}}`, `{}`, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			old, new := decodeJSON(t, tt.old), decodeJSON(t, tt.new)
+			patch, changed := mergePatch(old, new)
+			if changed != tt.changed {
+				t.Errorf("changed is %v, want %v", changed, tt.changed)
+			}
+			if !changed {
+				return
+			}
+			if want := decodeJSON(t, tt.patch); !reflect.DeepEqual(patch, want) {
+				t.Errorf("got patch %v, want %v", patch, want)
+			}
+			if got := applyMergePatch(old, patch); !reflect.DeepEqual(got, new) {
+				t.Errorf("applying the patch gave %v, want %v", got, new)
+			}
+		})
+	}
+}
+
+// Views go out in full, then as patches against the last one sent, and not at all if they haven't changed
+// other targets are always sent in full, and a resync sends the next view in full again
+func TestOutboxPatch(t *testing.T) {
+	o := newOutbox()
+	o.startPatches()
+	big := `{"Players":["alice","bob","carol"],"Status":"lobby","Host":"alice"}`
+	for _, tt := range []struct {
+		name   string
+		target string
+		state  string
+		resync bool
+		sent   bool
+		patch  string
+		base   int
+	}{
+		{"first view", TargetLobby, big, false, true, "", 0},
+		{"small change", TargetLobby, `{"Players":["alice","bob","carol"],"Status":"game","Host":"alice"}`, false, true, `{"Status":"game"}`, 1},
+		{"unchanged", TargetLobby, `{"Players":["alice","bob","carol"],"Status":"game","Host":"alice"}`, false, false, "", 0},
+		{"not patched", TargetError, `{"Code":"badArgs"}`, false, true, "", 0},
+		{"other target", TargetGame, `{"Turn":"alice"}`, false, true, "", 0},
+		{"patch against the last one sent", TargetLobby, big, false, true, `{"Status":"lobby"}`, 2},
+		{"resync", TargetLobby, big, true, true, "", 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.resync {
+				o.resync()
+			}
+			message, _ := json.Marshal(lobbyMsg{tt.target, json.RawMessage(tt.state)})
+			data := o.next(message)
+			if (data != nil) != tt.sent {
+				t.Fatalf("sent %s, want sent %v", data, tt.sent)
+			}
+			if data == nil {
+				return
+			}
+			var out sentMsg
+			if err := json.Unmarshal(data, &out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Seq != o.seq {
+				t.Errorf("sent with sequence number %d, want %d", out.Seq, o.seq)
+			}
+			if tt.patch == "" {
+				if out.Patch != nil || !reflect.DeepEqual(decodeJSON(t, string(out.State)), decodeJSON(t, tt.state)) {
+					t.Errorf("got state %s and patch %s, want state %s in full", out.State, out.Patch, tt.state)
+				}
+				return
+			}
+			if out.State != nil || out.Base != tt.base || !reflect.DeepEqual(decodeJSON(t, string(out.Patch)), decodeJSON(t, tt.patch)) {
+				t.Errorf("got state %s and patch %s against %d, want patch %s against %d", out.State, out.Patch, out.Base, tt.patch, tt.base)
+			}
+		})
+	}
+}
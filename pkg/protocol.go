@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// The version of the websocket protocol, bumped whenever a change would break existing clients
+const ProtocolVersion = 1
+
+// The oldest protocol version the server still speaks
+const minProtocolVersion = 1
+
+// Message targets, what a command is for or what an event is about
+const (
+	TargetHello   string = "hello"
+	TargetLobby   string = "lobby"
+	TargetGame    string = "game"
+	TargetSession string = "session"
+	TargetError   string = "error"
+	TargetNotice  string = "notice"
+	TargetResume  string = "resume"
+)
+
+// How a command arg is written, args are always sent as strings
+const (
+	ArgString string = "string"
+	ArgInt    string = "int"
+	ArgBool   string = "bool"
+)
+
+// An arg a command takes:
+// - its name and how it's written
+// - whether the command needs it
+// - the only values it can have, if it's one of a few
+type argSpec struct {
+	Name        string
+	Type        string
+	Required    bool
+	Enum        []string
+	Description string
+}
+
+// A command clients can send, as a userMsg:
+// - the target and command name it's sent with, hello has no command name
+// - whether only the host can send it
+// - the args it takes, and whether it also takes the options of the game being started
+type commandSpec struct {
+	Target      string
+	Cmd         string
+	Description string
+	HostOnly    bool
+	Args        []argSpec
+	GameOptions bool
+}
+
+// An event the server sends, as a lobbyMsg, and the type of its state
+type eventSpec struct {
+	Target      string
+	Description string
+	State       interface{}
+}
+
+// The server's answer to a hello, with the protocol versions it speaks
+// and whether it'll send patches from now on
+type helloEvent struct {
+	Version    int
+	MinVersion int
+	Patches    bool
+}
+
+// Check a command's args are all there and written the right way
+func (c commandSpec) check(args map[string]string) *gameError {
+	for _, arg := range c.Args {
+		value, ok := args[arg.Name]
+		if !ok || value == "" {
+			if arg.Required {
+				return &gameError{ErrBadArgs, fmt.Sprintf("%s needs a %s", c.name(), arg.Name)}
+			}
+			continue
+		}
+		valid := true
+		switch arg.Type {
+		case ArgInt:
+			_, err := strconv.Atoi(value)
+			valid = err == nil
+		case ArgBool:
+			_, err := strconv.ParseBool(value)
+			valid = err == nil
+		}
+		if len(arg.Enum) > 0 && !containsId(arg.Enum, value) {
+			valid = false
+		}
+		if !valid {
+			return &gameError{ErrBadArgs, fmt.Sprintf("invalid %s %q for %s", arg.Name, value, c.name())}
+		}
+	}
+	return nil
+}
+
+func (c commandSpec) name() string {
+	if c.Cmd == "" {
+		return c.Target
+	}
+	return c.Cmd
+}
+
+// Find a command by name
+func lookupCommand(specs []commandSpec, cmd string) (commandSpec, bool) {
+	for _, spec := range specs {
+		if spec.Cmd == cmd {
+			return spec, true
+		}
+	}
+	return commandSpec{}, false
+}
+
+var helloCommand = commandSpec{
+	Target:      TargetHello,
+	Description: "The first thing a client sends, saying which protocol version it speaks. Clients that skip it are treated as version 1",
+	Args: []argSpec{
+		{Name: "version", Type: ArgInt, Required: true, Description: "Protocol version the client speaks"},
+		{Name: "client", Type: ArgString, Description: "Name of the client, for the server's logs"},
+		{Name: "patches", Type: ArgBool, Description: "Send lobby and game views as sequence numbered JSON merge patches against the last view, see patchMsg"},
+	},
+}
+
+var lobbyCommands = []commandSpec{
+	{
+		Target: TargetLobby, Cmd: "startGame", HostOnly: true, GameOptions: true,
+		Description: "Start a game, or the first round of a match if rounds or target is set. Also takes any of the game's options",
+		Args: []argSpec{
+			{Name: "game", Type: ArgString, Description: "Game to play, the default game if left out"},
+			{Name: MatchRounds, Type: ArgInt, Description: "Play a match of this many rounds"},
+			{Name: MatchTarget, Type: ArgInt, Description: "Play a match until someone's total reaches this"},
+		},
+	},
+	{Target: TargetLobby, Cmd: "quitGame", HostOnly: true, Description: "End the running game, and the match if one is being played"},
+	{Target: TargetLobby, Cmd: "backToLobby", Description: "Go back to the lobby after a game's over"},
+	{Target: TargetLobby, Cmd: "resync", Description: "Send the lobby and game views in full again, for a client getting patches that's missed one"},
+	{
+		Target: TargetLobby, Cmd: "resume", Description: "Resend everything after a sequence number, for a client that reconnected or spotted a gap",
+		Args: []argSpec{
+			{Name: "seq", Type: ArgInt, Required: true, Description: "Sequence number of the last message the client got"},
+		},
+	},
+	{Target: TargetLobby, Cmd: "nextRound", HostOnly: true, Description: "Deal the match's next round without waiting"},
+	{
+		Target: TargetLobby, Cmd: "addBot", Description: "Add a bot player",
+		Args: []argSpec{
+			{Name: "level", Type: ArgString, Enum: botLevelNames(), Description: "How well the bot plays, " + BotRandom + " if left out"},
+		},
+	},
+	{
+		Target: TargetLobby, Cmd: "kick", HostOnly: true, Description: "Remove someone from the lobby, players only between games",
+		Args: []argSpec{
+			{Name: Player, Type: ArgString, Required: true, Description: "Who to kick"},
+		},
+	},
+	{
+		Target: TargetLobby, Cmd: "changeHost", HostOnly: true, Description: "Hand host over to someone else",
+		Args: []argSpec{
+			{Name: Player, Type: ArgString, Required: true, Description: "The new host"},
+		},
+	},
+	{
+		Target: TargetLobby, Cmd: "changeTeam", Description: "Switch between playing and spectating, only between games",
+		Args: []argSpec{
+			{Name: "team", Type: ArgString, Required: true, Enum: []string{Players, Spectators}, Description: "Team to switch to"},
+		},
+	},
+}
+
+var lobbyEvents = []eventSpec{
+	{TargetHello, "The answer to a hello", helloEvent{}},
+	{TargetSession, "The session token for reconnecting as the same user, sent on joining", ""},
+	{TargetLobby, "The lobby's state, sent whenever it changes", lobbyState{}},
+	{TargetError, "Why the last command from this user was rejected", gameError{}},
+	{TargetNotice, "A notice from the server, like it restarting", ""},
+	{TargetResume, "The answer to a resume, once everything missed has been resent", resumeEvent{}},
+}
+
+func botLevelNames() []string {
+	names := []string{}
+	for level := range botLevels {
+		names = append(names, level)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handle a hello, the first message on a connection:
+// - answer with the versions the server speaks
+// - if the server doesn't speak the client's version, say so and close their connection
+func (l *lobby) handleHello(id string, msg *userMsg) {
+	err := helloCommand.check(msg.Args)
+	version, _ := strconv.Atoi(msg.Args["version"])
+	if err == nil && (version < minProtocolVersion || version > ProtocolVersion) {
+		text := fmt.Sprintf("protocol version %d isn't supported, this server speaks versions %d to %d", version, minProtocolVersion, ProtocolVersion)
+		err = &gameError{ErrBadVersion, text}
+	}
+	u, ok := l.users[id]
+	if !ok {
+		return
+	}
+	if err != nil {
+		fmt.Println("lobby removing", id, "for", err)
+		l.sendError(id, err)
+		u.closeCode = websocket.CloseProtocolError
+		u.closeReason = "unsupported protocol version"
+		l.removeUser(id)
+		return
+	}
+	fmt.Println("hello from", id, "client", msg.Args["client"], "version", version)
+	patches, _ := strconv.ParseBool(msg.Args["patches"])
+	if patches {
+		u.out.startPatches()
+	}
+	reply, _ := json.Marshal(lobbyMsg{TargetHello, helloEvent{ProtocolVersion, minProtocolVersion, patches}})
+	u.send(reply)
+}
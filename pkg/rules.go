@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// House rule options for starting a bunga game
+const (
+	HandSize       string = "handSize"
+	PeekCount      string = "peekCount"
+	RedKingScore   string = "redKingScore"
+	BungaPenalty   string = "bungaPenalty"
+	BungaThreshold string = "bungaThreshold"
+	TagPenalty     string = "tagPenalty"
+	Powers         string = "powers"
+	Decks          string = "decks"
+	TurnTime       string = "turnTime"
+	AwayAfter      string = "awayAfter"
+	Jokers         string = "jokers"
+	JokerScore     string = "jokerScore"
+	JokerPower     string = "jokerPower"
+	AssistedMemory string = "assistedMemory"
+)
+
+const maxTagPenalty = 3
+const maxDecks = 3
+const maxTurnTime = 600
+
+// The two jokers, their first character isn't a rank like it is for every other card
+var jokerCards = []string{"1J", "2J"}
+
+const jokerRank byte = '*'
+
+// What a discarded card lets you do, named after the card with the same power by default
+var powerStates = map[string]string{
+	"none":      "",
+	"lookOwn":   LookOwnChoice,
+	"lookOther": LookOtherChoice,
+	"swap":      SwapOtherChoice,
+	"lookSwap":  LookSwapChoice,
+}
+
+// The house rules a game is played with:
+// - how many cards everyone is dealt, and how many of them they get to peek at
+// - how many points a red king is worth at the end
+// - the penalty for calling bunga with a score at or above the threshold
+// - how many cards someone picks up for tagging the wrong card
+// - which ranks have a discard power, and what it is
+// - how many decks are shuffled together, 0 picks enough for the number of players
+// - how many seconds everyone gets for a turn, 0 for no turn clock
+// - how many turns in a row someone can run out of time on before they're shown as away, 0 for never
+// - whether the two jokers are shuffled into the deck
+// - how many points a joker is worth at the end
+// - which discard power a joker has
+// - whether everyone is shown the cards they've seen, wherever those cards have gone since
+//
+// Whatever the house rules, once a move leaves the draw pile with one card or none,
+// all but the top of the discard pile is shuffled in under it, so what's on top of the draw pile stays put.
+// Penalty cards for a wrong tag stop short of leaving fewer than two cards between the two piles,
+// and each one skipped shows up in the latest actions as a wrong card on the draw pile
+type bungaRules struct {
+	HandSize       int
+	PeekCount      int
+	RedKingScore   int
+	BungaPenalty   int
+	BungaThreshold int
+	TagPenalty     int
+	Powers         map[string]string
+	Decks          int
+	TurnTime       int
+	AwayAfter      int
+	Jokers         bool
+	JokerScore     int
+	JokerPower     string
+	AssistedMemory bool
+}
+
+func defaultRules() bungaRules {
+	return bungaRules{
+		HandSize:       StartHandSize,
+		PeekCount:      2,
+		RedKingScore:   -1,
+		BungaPenalty:   10,
+		BungaThreshold: 10,
+		TagPenalty:     1,
+		Powers: map[string]string{
+			"7": "lookOwn", "8": "lookOwn",
+			"9": "lookOther", "T": "lookOther",
+			"J": "swap",
+			"Q": "lookSwap",
+		},
+		Decks:          0,
+		TurnTime:       0,
+		AwayAfter:      2,
+		Jokers:         false,
+		JokerScore:     0,
+		JokerPower:     "none",
+		AssistedMemory: false,
+	}
+}
+
+// Read the house rules out of the start game arguments, anything left out keeps its default
+func parseRules(args map[string]string) (bungaRules, error) {
+	r := defaultRules()
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{
+		{HandSize, &r.HandSize},
+		{PeekCount, &r.PeekCount},
+		{RedKingScore, &r.RedKingScore},
+		{BungaPenalty, &r.BungaPenalty},
+		{BungaThreshold, &r.BungaThreshold},
+		{TagPenalty, &r.TagPenalty},
+		{Decks, &r.Decks},
+		{TurnTime, &r.TurnTime},
+		{AwayAfter, &r.AwayAfter},
+		{JokerScore, &r.JokerScore},
+	} {
+		if args[setting.name] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(args[setting.name])
+		if err != nil {
+			return r, fmt.Errorf("invalid %s %q", setting.name, args[setting.name])
+		}
+		*setting.value = n
+	}
+	for _, setting := range []struct {
+		name  string
+		value *bool
+	}{
+		{Jokers, &r.Jokers},
+		{AssistedMemory, &r.AssistedMemory},
+	} {
+		if args[setting.name] == "" {
+			continue
+		}
+		on, err := strconv.ParseBool(args[setting.name])
+		if err != nil {
+			return r, fmt.Errorf("invalid %s %q", setting.name, args[setting.name])
+		}
+		*setting.value = on
+	}
+	if args[JokerPower] != "" {
+		r.JokerPower = args[JokerPower]
+	}
+	// powers look like "7:lookOwn,J:swap", ranks left out have no power
+	if args[Powers] != "" {
+		r.Powers = map[string]string{}
+		for _, pair := range strings.Split(args[Powers], ",") {
+			rank, power, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok {
+				return r, fmt.Errorf("invalid %s %q, use rank:power pairs", Powers, pair)
+			}
+			r.Powers[rank] = power
+		}
+	}
+	return r, r.validate()
+}
+
+// Check the rules make a playable game, the player count is checked when dealing
+func (r bungaRules) validate() error {
+	if r.HandSize < 1 {
+		return fmt.Errorf("%s must be at least 1", HandSize)
+	}
+	if r.PeekCount < 0 || r.PeekCount > r.HandSize {
+		return fmt.Errorf("%s must be between 0 and %s", PeekCount, HandSize)
+	}
+	if r.Decks < 0 || r.Decks > maxDecks {
+		return fmt.Errorf("%s must be between 0, for enough to deal everyone in, and %d", Decks, maxDecks)
+	}
+	if r.TurnTime < 0 || r.TurnTime > maxTurnTime {
+		return fmt.Errorf("%s must be between 0, for no turn clock, and %d seconds", TurnTime, maxTurnTime)
+	}
+	if r.AwayAfter < 0 {
+		return fmt.Errorf("%s can't be negative", AwayAfter)
+	}
+	if r.BungaPenalty < 0 {
+		return fmt.Errorf("%s can't be negative", BungaPenalty)
+	}
+	if r.TagPenalty < 0 || r.TagPenalty > maxTagPenalty {
+		return fmt.Errorf("%s must be between 0 and %d", TagPenalty, maxTagPenalty)
+	}
+	for rank, power := range r.Powers {
+		if len(rank) != 1 || !strings.Contains("23456789TJQKA", rank) {
+			return fmt.Errorf("invalid rank %q in %s", rank, Powers)
+		}
+		if _, ok := powerStates[power]; !ok {
+			return fmt.Errorf("invalid power %q for %s, pick one of %s", power, rank, powerNames())
+		}
+	}
+	if _, ok := powerStates[r.JokerPower]; !ok {
+		return fmt.Errorf("invalid %s %q, pick one of %s", JokerPower, r.JokerPower, powerNames())
+	}
+	return nil
+}
+
+// How many cards are in the deck with these rules, counting as many decks as could be used
+func (r bungaRules) deckSize() int {
+	decks := r.Decks
+	if decks == 0 {
+		decks = maxDecks
+	}
+	if r.Jokers {
+		return decks * (deckSize + len(jokerCards))
+	}
+	return decks * deckSize
+}
+
+// The most players that can be dealt in and still leave a draw pile
+func (r bungaRules) maxPlayers() int {
+	return (r.deckSize() - minDrawPile) / r.HandSize
+}
+
+// The most players a single deck deals in and still leaves a draw pile
+func (r bungaRules) oneDeckPlayers() int {
+	r.Decks = 1
+	return r.maxPlayers()
+}
+
+// The fewest decks that deal everyone in and still leave a draw pile
+func (r bungaRules) decksFor(players int) int {
+	for decks := 1; decks < maxDecks; decks++ {
+		r.Decks = decks
+		if players <= r.maxPlayers() {
+			return decks
+		}
+	}
+	return maxDecks
+}
+
+func powerNames() string {
+	names := []string{}
+	for name := range powerStates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// The playing state discarding the card leads to, or "" if it has no power
+func (r bungaRules) power(card string) string {
+	if isJoker(card) {
+		return powerStates[r.JokerPower]
+	}
+	return powerStates[r.Powers[string(cardRank(card))]]
+}
+
+func isJoker(card string) bool {
+	for _, joker := range jokerCards {
+		if strings.HasPrefix(card, joker) {
+			return true
+		}
+	}
+	return false
+}
+
+// The rank of a card, for matching cards when tagging and for looking up discard powers
+func cardRank(card string) byte {
+	if isJoker(card) {
+		return jokerRank
+	}
+	return card[0]
+}
+
+// How many points a card is worth at the end of the game
+func (r bungaRules) cardValue(card string) int {
+	switch cardRank(card) {
+	case '2', '3', '4', '5', '6', '7', '8', '9':
+		num, _ := strconv.Atoi(string(card[0]))
+		return num
+	case 'T', 'J', 'Q':
+		return 10
+	case 'K':
+		if card[1] == 'H' || card[1] == 'D' {
+			return r.RedKingScore
+		}
+		return 25
+	case jokerRank:
+		return r.JokerScore
+	}
+	// Aces are worth nothing
+	return 0
+}
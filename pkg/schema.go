@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// The JSON Schema for the websocket protocol, generated from the command and event specs
+// and the Go types of each event's state
+func protocolSchema() map[string]interface{} {
+	defs := map[string]interface{}{}
+	commands := []interface{}{commandSchema(helloCommand)}
+	for _, spec := range lobbyCommands {
+		commands = append(commands, commandSchema(spec))
+	}
+	events := []interface{}{}
+	for _, spec := range lobbyEvents {
+		events = append(events, eventSchema(spec, defs))
+	}
+	for _, info := range gameInfos() {
+		t, _ := lookupGame(info.Name)
+		for _, spec := range t.commands {
+			commands = append(commands, commandSchema(spec))
+		}
+		if t.view != nil {
+			events = append(events, eventSchema(eventSpec{TargetGame, "What a player or spectator sees of a " + info.Name + " game, sent whenever it changes", t.view}, defs))
+		}
+	}
+	defs["command"] = map[string]interface{}{
+		"description": "A command sent by a client. Keys are matched case insensitively, and every arg is a string",
+		"oneOf":       commands,
+	}
+	// clients that asked for patches get lobby and game views as patches against the last one
+	patch := typeSchema(reflect.TypeOf(sentMsg{}), defs)
+	patch["description"] = "A lobby or game view as a JSON merge patch against the one sent with the Base sequence number, for clients that asked for patches in their hello"
+	events = append(events, patch)
+	defs["event"] = map[string]interface{}{
+		"description": "An event sent by the server, numbered in the order it was sent",
+		"oneOf":       events,
+	}
+	return map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "bunga websocket protocol",
+		"description": fmt.Sprintf("Version %d, every websocket message is one command or event as JSON text", ProtocolVersion),
+		"version":     ProtocolVersion,
+		"oneOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/command"},
+			map[string]interface{}{"$ref": "#/$defs/event"},
+		},
+		"$defs": defs,
+	}
+}
+
+func commandSchema(spec commandSpec) map[string]interface{} {
+	args := map[string]interface{}{}
+	required := []string{}
+	for _, arg := range spec.Args {
+		args[arg.Name] = argSchema(arg)
+		if arg.Required {
+			required = append(required, arg.Name)
+		}
+	}
+	// startGame also takes every option of the game being started
+	if spec.GameOptions {
+		for _, info := range gameInfos() {
+			for _, option := range info.Options {
+				if _, ok := args[option.Name]; !ok {
+					args[option.Name] = map[string]interface{}{
+						"type":        "string",
+						"description": fmt.Sprintf("%s option: %s, %s by default", info.Name, option.Description, option.Default),
+					}
+				}
+			}
+		}
+	}
+	argsSchema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           args,
+		"additionalProperties": map[string]interface{}{"type": "string"},
+	}
+	if len(required) > 0 {
+		argsSchema["required"] = required
+	}
+	properties := map[string]interface{}{
+		"Target": map[string]interface{}{"const": spec.Target},
+		"Args":   argsSchema,
+	}
+	schemaRequired := []string{"Target"}
+	if spec.Cmd != "" {
+		properties["Cmd"] = map[string]interface{}{"const": spec.Cmd}
+		schemaRequired = append(schemaRequired, "Cmd")
+	}
+	if len(required) > 0 {
+		schemaRequired = append(schemaRequired, "Args")
+	}
+	description := spec.Description
+	if spec.HostOnly {
+		description += ". Only the host can send it"
+	}
+	return map[string]interface{}{
+		"title":       spec.name(),
+		"description": description,
+		"type":        "object",
+		"properties":  properties,
+		"required":    schemaRequired,
+	}
+}
+
+func argSchema(arg argSpec) map[string]interface{} {
+	ret := map[string]interface{}{
+		"type":        "string",
+		"description": arg.Description,
+	}
+	switch arg.Type {
+	case ArgInt:
+		ret["pattern"] = "^[+-]?[0-9]+$"
+	case ArgBool:
+		ret["enum"] = []string{"true", "false"}
+	}
+	if len(arg.Enum) > 0 {
+		ret["enum"] = arg.Enum
+	}
+	return ret
+}
+
+func eventSchema(spec eventSpec, defs map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"title":       spec.Target,
+		"description": spec.Description,
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"Target": map[string]interface{}{"const": spec.Target},
+			"Seq":    map[string]interface{}{"type": "integer"},
+			"State":  typeSchema(reflect.TypeOf(spec.State), defs),
+		},
+		"required": []string{"Target", "Seq", "State"},
+	}
+}
+
+// The schema for how a Go type is written as JSON, structs go in defs by name
+func typeSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return map[string]interface{}{
+			"anyOf": []interface{}{typeSchema(t.Elem(), defs), map[string]interface{}{"type": "null"}},
+		}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+		if _, ok := defs[t.Name()]; ok {
+			return ref
+		}
+		// claim the name first, so a struct that contains itself doesn't recurse forever
+		defs[t.Name()] = nil
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := field.Name
+			if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			properties[name] = typeSchema(field.Type, defs)
+		}
+		defs[t.Name()] = map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+		return ref
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem(), defs),
+		}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem(), defs),
+		}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	// interface{} fields can hold anything
+	return map[string]interface{}{}
+}
+
+// Serve the protocol's JSON Schema, for building other clients against
+func handleProtocol(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.MarshalIndent(protocolSchema(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(resp)
+}
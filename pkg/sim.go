@@ -0,0 +1,303 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// How a simulation is set up:
+// - how many games to play, and the seed of the first one, the rest count up from it
+// - the bot level for each player, and the house rules they play by
+// - how many moves a game gets before it's given up on
+type simConfig struct {
+	games    int
+	seed     int64
+	levels   []string
+	rules    bungaRules
+	maxMoves int
+}
+
+// How one simulated game went:
+// - the seed it was dealt with and the state it ended in
+// - whether it got to the end before running out of moves
+// - how many moves were accepted and rejected, and how many times the bots all had nothing to do
+// - what went wrong, if it panicked or broke the rules of the game
+type simResult struct {
+	seed      int64
+	state     bungaGameState
+	finished  bool
+	moves     int
+	rejected  int
+	timeouts  int
+	err       error
+	violation string
+}
+
+// A game's seed deals it, and is mixed into separate streams for the order moves race in and each seat's bot,
+// counted down from -1 so they never meet the deal's shuffles, which count up from 0
+const (
+	simMoveStream int64 = -1
+	simBotStream  int64 = -2
+)
+
+// Totals for one bot over every game
+type simStats struct {
+	level        string
+	wins         int
+	scores       int
+	calls        int
+	callsWon     int
+	callsPenalty int
+}
+
+// Run the sim subcommand, returning the exit code
+// house rules are given after the flags as name=value, the same as startGame options
+func runSim(args []string) int {
+	fs := flag.NewFlagSet("sim", flag.ContinueOnError)
+	games := fs.Int("games", 1000, "games to play")
+	seed := fs.Int64("seed", 0, "seed of the first game, the rest count up from it, 0 for a random one")
+	bots := fs.String("bots", BotMemory+","+BotRandom, "comma separated bot level for each player: "+strings.Join(botLevelNames(), ", "))
+	maxMoves := fs.Int("maxMoves", 5000, "moves a game gets before it's given up on")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: bunga sim [flags] [rule=value ...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	options := map[string]string{}
+	for _, arg := range fs.Args() {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			fmt.Println("house rules are given as name=value, not", strconv.Quote(arg))
+			return 2
+		}
+		options[name] = value
+	}
+	rules, err := parseRules(options)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	levels := strings.Split(*bots, ",")
+	for _, level := range levels {
+		if _, ok := botLevels[level]; !ok {
+			fmt.Printf("unknown bot level %q, pick from %s\n", level, strings.Join(botLevelNames(), ", "))
+			return 2
+		}
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	if _, err := NewGame(rules, simPlayers(len(levels)), *seed); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	results := simulate(simConfig{*games, *seed, levels, rules, *maxMoves})
+	simReport(os.Stdout, levels, results)
+	for _, r := range results {
+		if r.err != nil || r.violation != "" {
+			return 1
+		}
+	}
+	return 0
+}
+
+func simPlayers(n int) []string {
+	ret := []string{}
+	for i := 1; i <= n; i++ {
+		ret = append(ret, "bot "+strconv.Itoa(i))
+	}
+	return ret
+}
+
+// Play every game, with the first seat picked by the seed so nobody always goes first
+// and any game can be played again on its own with its seed
+func simulate(c simConfig) []simResult {
+	players := simPlayers(len(c.levels))
+	levels := map[string]string{}
+	for i, player := range players {
+		levels[player] = c.levels[i]
+	}
+	ret := []simResult{}
+	n := int64(len(players))
+	for i := 0; i < c.games; i++ {
+		seed := c.seed + int64(i)
+		first := int((seed%n + n) % n)
+		order := append(append([]string{}, players[first:]...), players[:first]...)
+		ret = append(ret, simGame(c.rules, levels, order, seed, c.maxMoves))
+	}
+	return ret
+}
+
+// Play one game between bots, through the same engine a lobby uses:
+// - every bot gets its view after each move, and picks the move it would send
+// - the moves race like they would in a lobby, so a random bot with a move gets to go next
+// - a bot whose move on its own turn is rejected tries something random, the way it would in a lobby
+// - if no bot has anything to do, the turn clock runs out
+func simGame(rules bungaRules, levels map[string]string, order []string, seed int64, maxMoves int) (ret simResult) {
+	ret.seed = seed
+	defer func() {
+		if r := recover(); r != nil {
+			ret.err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	state, err := NewGame(rules, order, seed)
+	if err != nil {
+		ret.err = err
+		return ret
+	}
+	rng := rand.New(rand.NewSource(mixSeed(seed, simMoveStream)))
+	botSeed := mixSeed(seed, simBotStream)
+	bots := map[string]*bot{}
+	for i, player := range order {
+		bots[player] = newBot(player, levels[player], mixSeed(botSeed, int64(i)))
+	}
+	pending := map[string]*userMsg{}
+	observe := func() {
+		// every player's view at once, rather than working them all out again for each one through View
+		views := state.getUserStates()
+		for _, player := range order {
+			view, ok := views[player]
+			if !ok {
+				view = views[Final]
+			}
+			bots[player].observe(view)
+			pending[player] = bots[player].nextMove()
+		}
+	}
+	observe()
+	for steps := 0; steps < maxMoves && state.GameState != EndGame; steps++ {
+		ready := []string{}
+		for _, player := range order {
+			if pending[player] != nil {
+				ready = append(ready, player)
+			}
+		}
+		var move userMsg
+		if len(ready) == 0 {
+			turn := ""
+			if state.GameState == Playing {
+				turn = state.Turn
+			}
+			move = userMsg{Target: Timer, Cmd: Timeout, Args: map[string]string{Player: turn}}
+			ret.timeouts++
+		} else {
+			player := ready[rng.Intn(len(ready))]
+			move = *pending[player]
+			pending[player] = nil
+		}
+		next, _, err := Apply(state, move)
+		if err != nil {
+			ret.rejected++
+			if player := move.Args[Player]; move.Target != Timer && state.GameState == Playing && state.Turn == player {
+				pending[player] = bots[player].randomMove()
+			}
+			continue
+		}
+		state = next
+		ret.moves++
+		if broken := state.invariants(); len(broken) > 0 {
+			ret.violation = strings.Join(broken, ", ")
+			break
+		}
+		observe()
+	}
+	ret.state = state
+	ret.finished = state.GameState == EndGame
+	return ret
+}
+
+// Print win rates and scores for each bot, how long games went, how well bunga was called,
+// how often the draw pile ran out, and anything that went wrong
+func simReport(w io.Writer, levels []string, results []simResult) {
+	players := simPlayers(len(levels))
+	stats := map[string]*simStats{}
+	for i, player := range players {
+		stats[player] = &simStats{level: levels[i]}
+	}
+	finished, moves, turns, reshuffles, reshuffled, rejected, timeouts := 0, 0, 0, 0, 0, 0, 0
+	minTurns, maxTurns := 0, 0
+	failed := []simResult{}
+	for _, r := range results {
+		rejected += r.rejected
+		timeouts += r.timeouts
+		if r.err != nil || r.violation != "" {
+			failed = append(failed, r)
+			continue
+		}
+		if !r.finished {
+			continue
+		}
+		finished++
+		s := r.state
+		moves += r.moves
+		turns += s.Turns
+		if finished == 1 || s.Turns < minTurns {
+			minTurns = s.Turns
+		}
+		if s.Turns > maxTurns {
+			maxTurns = s.Turns
+		}
+		// the first shuffle is the deal
+		reshuffles += s.Shuffles - 1
+		if s.Shuffles > 1 {
+			reshuffled++
+		}
+		stats[s.Winner].wins++
+		for player, score := range s.Scores {
+			stats[player].scores += score
+		}
+		if s.SaidBunga != "" {
+			caller := stats[s.SaidBunga]
+			caller.calls++
+			if s.Winner == s.SaidBunga {
+				caller.callsWon++
+			}
+			if s.Scores[s.SaidBunga]-s.Rules.BungaPenalty >= s.Rules.BungaThreshold {
+				caller.callsPenalty++
+			}
+		}
+	}
+	percent := func(n, of int) string {
+		if of == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(of))
+	}
+	average := func(n, of int) string {
+		if of == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f", float64(n)/float64(of))
+	}
+
+	fmt.Fprintf(w, "%d games of %s, %d finished\n\n", len(results), strings.Join(levels, " vs "), finished)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "player\tbot\twins\twin rate\tavg score\tbunga calls\tcaller won\tcalled too early")
+	for _, player := range players {
+		s := stats[player]
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%d\t%s\t%s\n", player, s.level, s.wins, percent(s.wins, finished),
+			average(s.scores, finished), s.calls, percent(s.callsWon, s.calls), percent(s.callsPenalty, s.calls))
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "game length: %s moves and %s turns on average, %d to %d turns\n", average(moves, finished), average(turns, finished), minTurns, maxTurns)
+	fmt.Fprintf(w, "reshuffles: %s a game, in %s of games\n", average(reshuffles, finished), percent(reshuffled, finished))
+	fmt.Fprintf(w, "rejected moves: %d, turn clock run outs: %d\n", rejected, timeouts)
+	fmt.Fprintf(w, "panics and rule violations: %d\n", len(failed))
+	for _, r := range failed {
+		problem := r.violation
+		if r.err != nil {
+			problem = r.err.Error()
+		}
+		fmt.Fprintf(w, "  seed %d: %s\n", r.seed, problem)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Where lobby snapshots are kept, empty turns saving and restoring off
+var stateDir string
+
+// A saved lobby has:
+// - its name and lobby state, scores and match included
+// - session tokens, so people can reconnect after a restart
+// - the bots and their levels
+// - the settings for the match being played
+// - the running game's type and its own snapshot, if there is one
+type lobbySnapshot struct {
+	Name      string
+	State     lobbyState
+	Sessions  map[string]string
+	Bots      map[string]string
+	MatchArgs map[string]string
+	Game      string
+	GameState json.RawMessage
+}
+
+func snapshotPath(name string) string {
+	return filepath.Join(stateDir, name+".json")
+}
+
+// Write the lobby to its snapshot file, replacing the old one in one go
+// so a crash halfway through never leaves a broken snapshot behind
+func (l *lobby) saveSnapshot() {
+	if stateDir == "" {
+		return
+	}
+	l.saveLock.Lock()
+	defer l.saveLock.Unlock()
+	if l.ended {
+		return
+	}
+	l.userLock.Lock()
+	snap := lobbySnapshot{
+		Name:      l.name,
+		State:     l.state,
+		Sessions:  l.sessions,
+		Bots:      l.bots,
+		MatchArgs: l.matchArgs,
+	}
+	if l.g != nil && l.gameSnapshot != nil {
+		snap.Game = l.gameType.info.Name
+		snap.GameState = json.RawMessage(l.gameSnapshot)
+	}
+	data, err := json.Marshal(snap)
+	l.userLock.Unlock()
+	if err != nil {
+		fmt.Println("couldn't snapshot lobby", l.name, err)
+		return
+	}
+	tmp := snapshotPath(l.name) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		fmt.Println("couldn't save lobby", l.name, err)
+		return
+	}
+	if err := os.Rename(tmp, snapshotPath(l.name)); err != nil {
+		fmt.Println("couldn't save lobby", l.name, err)
+	}
+}
+
+// Stop saving the lobby and throw away its snapshot, it's not coming back
+func (l *lobby) removeSnapshot() {
+	l.saveLock.Lock()
+	defer l.saveLock.Unlock()
+	l.ended = true
+	if stateDir == "" {
+		return
+	}
+	if err := os.Remove(snapshotPath(l.name)); err != nil && !os.IsNotExist(err) {
+		fmt.Println("couldn't remove lobby", l.name, err)
+	}
+}
+
+// Bring back every saved lobby:
+// - people come back as away, with the usual grace period to reconnect
+// - bots come back and keep playing
+// - a running game carries on from its last move, if its game type can restore it
+func restoreLobbies() {
+	if stateDir == "" {
+		return
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		fmt.Println("couldn't make state dir:", err)
+		return
+	}
+	files, err := os.ReadDir(stateDir)
+	if err != nil {
+		fmt.Println("couldn't read state dir:", err)
+		return
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(stateDir, file.Name()))
+		if err != nil {
+			fmt.Println("couldn't read lobby snapshot:", err)
+			continue
+		}
+		var snap lobbySnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			fmt.Println("couldn't read lobby snapshot", file.Name(), err)
+			continue
+		}
+		restoreLobby(snap)
+	}
+}
+
+func restoreLobby(snap lobbySnapshot) {
+	fmt.Println("Restoring lobby", snap.Name)
+	l := createLobby(snap.Name, lobbyDone, snap.State.MaxPlayers)
+	games := l.state.Games
+	l.state = snap.State
+	l.state.Games = games
+	l.state.Away = map[string]int64{}
+	l.state.Latency = map[string]int{}
+	if l.state.Scores == nil {
+		l.state.Scores = map[string]int{}
+	}
+	if snap.Sessions != nil {
+		l.sessions = snap.Sessions
+	}
+	l.matchArgs = snap.MatchArgs
+	away := []*user{}
+	for _, id := range append(append([]string{}, l.state.Players...), l.state.Spectators...) {
+		u := createUser(id)
+		l.wireUser(&u)
+		if level, ok := snap.Bots[id]; ok {
+			u.isBot = true
+			l.bots[id] = level
+			go newBot(id, level, time.Now().UnixNano()).run(&u)
+		} else {
+			go u.discard()
+			away = append(away, &u)
+		}
+		l.users[id] = &u
+	}
+	// set everything up before the lobby and game start running, so nothing else touches it yet
+	// nobody's connected, so everyone's views go out as they come back
+	// anyone dropped is gone before the game's restored, so it carries on without them
+	for _, u := range away {
+		if reconnectGrace <= 0 {
+			l.dropUser(u.id)
+		} else {
+			l.setAway(u)
+		}
+	}
+	if snap.Game != "" {
+		if err := l.restoreGame(snap.Game, snap.GameState); err != nil {
+			fmt.Println("couldn't restore game in lobby", snap.Name, err)
+		}
+	}
+	// the last game's final hands aren't saved, so go back to the lobby, a match deals its next round from there
+	if l.g == nil {
+		l.state.Status = "lobby"
+	}
+	if l.g == nil && l.state.Match != nil && l.state.Match.NextRound > 0 {
+		l.scheduleRound()
+	}
+	l.saveSnapshot()
+	addLobby(&l)
+	go l.runLobby()
+	if l.g != nil {
+		go l.g.runGame()
+	}
+}
+
+func (l *lobby) restoreGame(name string, data []byte) error {
+	t, ok := lookupGame(name)
+	if !ok || t.restore == nil {
+		return fmt.Errorf("%q games can't be restored", name)
+	}
+	lobbyToGame := make(chan userMsg)
+	gameToLobby := make(chan gameMsg)
+	g, err := t.restore(&l.state, data, lobbyToGame, gameToLobby)
+	if err != nil {
+		return err
+	}
+	l.lobbyToGame = lobbyToGame
+	l.gameToLobby = gameToLobby
+	l.gameType = t
+	l.g = g
+	l.gameSnapshot = data
+	return nil
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -11,16 +15,53 @@ import (
 // - user id
 // - lobbyToWeb channel
 // - webToLobby channel
-// - endConnection channel
-// - websocket connection object
+// - endConnection channel, for telling the lobby the connection closed
+// - latency channel, for telling the lobby how long pings take to come back
+// - quit channel, closed when the user is removed from the lobby
+// - the close code and reason their connection is closed with once quit is closed
+// - writerDone channel, closed once the close frame's been written
+// - outbox of everything sent to them, kept across reconnects
+// - resume channel, for asking the web writer to resend what they missed after a sequence number
+// - resumed channel, for the web writer telling the lobby how a resume went
+// - websocket connection object, nil for bots
 type user struct {
-	id         string
-	lobbyToWeb chan []byte
-	webToLobby chan []byte
-	endConn    chan string
-	c          *websocket.Conn
+	id          string
+	lobbyToWeb  chan []byte
+	webToLobby  chan webMsg
+	endConn     chan *user
+	latency     chan latencyReport
+	quit        chan struct{}
+	closeCode   int
+	closeReason string
+	writerDone  chan struct{}
+	out         *outbox
+	resume      chan int
+	resumed     chan resumeReport
+	isBot       bool
+	c           *websocket.Conn
 }
 
+// A message from a user to the lobby, tagged with who sent it
+type webMsg struct {
+	user string
+	data []byte
+}
+
+// How long a ping to the user took to come back
+type latencyReport struct {
+	u   *user
+	rtt time.Duration
+}
+
+// How often connections are pinged, 0 turns heartbeats off
+var pingInterval = 20 * time.Second
+
+// How long a connection can go without hearing anything, pongs included, before it's counted as dead
+var pongTimeout = 50 * time.Second
+
+// How long a write can take before the connection's counted as dead
+const writeWait = 10 * time.Second
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
@@ -37,35 +78,97 @@ func createUser(id string) user {
 		id:         id,
 		lobbyToWeb: make(chan []byte),
 		endConn:    nil,
+		quit:       make(chan struct{}),
+		closeCode:  websocket.CloseNormalClosure,
+		writerDone: make(chan struct{}),
+		out:        newOutbox(),
+		resume:     make(chan int),
 		c:          nil,
 	}
 }
 
+// A random session token, handed to a user so they can prove who they are when reconnecting
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Drop everything sent to a user who isn't connected yet, like one restored after a restart
+func (u *user) discard() {
+	for {
+		select {
+		case <-u.lobbyToWeb:
+		case <-u.quit:
+			return
+		}
+	}
+}
+
+// Remove the user with the given close code and reason, so their client knows why the connection's going away
+// anything already sent to them is written before the close frame
+func (u *user) close(code int, reason string) {
+	u.closeCode = code
+	u.closeReason = reason
+	close(u.quit)
+}
+
+// Wait a moment for the close frame to be written, for when the server's about to exit
+func (u *user) waitClosed() {
+	if u.c == nil {
+		return
+	}
+	select {
+	case <-u.writerDone:
+	case <-time.After(time.Second):
+	}
+}
+
+// Send a message to the user, dropping it if they've been removed from the lobby
+func (u *user) send(msg []byte) {
+	select {
+	case u.lobbyToWeb <- msg:
+	case <-u.quit:
+	}
+}
+
 // Main handler function:
 // - is a method on a user struct
 // - sets up connection
 // - starts reader and writer functions then ends
-func (u *user) runUser(w http.ResponseWriter, r *http.Request) {
+func (u *user) runUser(w http.ResponseWriter, r *http.Request) error {
 	fmt.Print("Upgrading request...")
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		fmt.Println("upgrade problem:", err)
-		return
+		return err
 	}
 	fmt.Println("Upgraded")
 
 	u.c = c
 	go u.webReader()
 	go u.webWriter()
+	return nil
 }
 
 // WebReader function:
 // - takes a pointer to the connection object and the webToLobby channel
 // - waits for messages from the websocket
 // - passes them to the channel
-// - if websocket is closed, send 'close' message to lobby and return
+// - on a pong, push back the read deadline and tell the lobby how long the ping took
+// - if websocket is closed, or nothing's been heard before the deadline, tell the lobby through endConnection and return
 func (u *user) webReader() {
 	defer u.c.Close()
+	defer func() {
+		select {
+		case u.endConn <- u:
+		case <-u.quit:
+		}
+	}()
+	if pingInterval > 0 {
+		u.c.SetReadDeadline(time.Now().Add(pongTimeout))
+		u.c.SetPongHandler(u.handlePong)
+	}
 	for {
 		_, message, err := u.c.ReadMessage()
 		if err != nil {
@@ -75,32 +178,76 @@ func (u *user) webReader() {
 			break
 		}
 		fmt.Println("Read message from user:", string(message))
-		u.webToLobby <- message
+		if pingInterval > 0 {
+			u.c.SetReadDeadline(time.Now().Add(pongTimeout))
+		}
+		u.webToLobby <- webMsg{u.id, message}
 	}
 }
 
+// Pings carry the time they were sent, so the pong says how long the round trip took
+func (u *user) handlePong(data string) error {
+	u.c.SetReadDeadline(time.Now().Add(pongTimeout))
+	sent, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return nil
+	}
+	select {
+	case u.latency <- latencyReport{u, time.Since(time.Unix(0, sent))}:
+	case <-u.quit:
+	}
+	return nil
+}
+
 // WebWriter function:
 // - takes a pointer to the connection object and the lobbyToWeb channel
-// - selects on the lobbyToWeb channel and endConnection channel
-// - takes messages and writes them to websocket connection
-// - if endConnection triggers, return
+// - selects on the lobbyToWeb channel and quit channel
+// - numbers messages and writes them to websocket connection, as patches if the user asked for them
+// - if writing fails, keep dropping messages until the lobby removes the user, they're kept in the outbox for resuming
+// - if the user resumes, resend what they missed
+// - ping the user every so often, so a dead connection gets noticed by the web reader
+// - if quit triggers, send a close frame with the user's close code and return
 func (u *user) webWriter() {
+	defer close(u.writerDone)
 	defer u.c.Close()
+	var ping <-chan time.Time
+	if pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
 	for {
 		select {
 		case message := <-u.lobbyToWeb:
-			w, err := u.c.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+			if message = u.out.next(message); message != nil {
+				u.write(message)
 			}
-			fmt.Print("writing message...", string(message))
-			w.Write(message)
-			if err := w.Close(); err != nil {
-				fmt.Println("writer error:", err)
+		case from := <-u.resume:
+			u.handleResume(from)
+		case <-ping:
+			now := time.Now()
+			if err := u.c.WriteControl(websocket.PingMessage, []byte(strconv.FormatInt(now.UnixNano(), 10)), now.Add(writeWait)); err != nil {
+				fmt.Println("ping error:", err)
 			}
-			fmt.Println("...finished writing")
-		case <-u.endConn:
+		case <-u.quit:
+			u.c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(u.closeCode, u.closeReason))
 			return
 		}
 	}
 }
+
+// Write one message to the websocket connection, only called by the web writer
+func (u *user) write(message []byte) {
+	u.c.SetWriteDeadline(time.Now().Add(writeWait))
+	w, err := u.c.NextWriter(websocket.TextMessage)
+	if err != nil {
+		fmt.Println("writer error:", err)
+		return
+	}
+	fmt.Print("writing message...", string(message))
+	w.Write(message)
+	if err := w.Close(); err != nil {
+		fmt.Println("writer error:", err)
+	}
+	fmt.Println("...finished writing")
+}
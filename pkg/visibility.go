@@ -0,0 +1,188 @@
+package main
+
+// Who can see what is tracked card by card, and views are made from nothing else
+// A card in someone's hand, or the top card of the draw pile, has:
+// - the players who know what it is, from seeing it since it got where it is
+// - the players it's face up for right now, who always know it too
+// Knowledge goes wherever the card goes, since everyone sees cards being swapped and tagged,
+// and it's lost once the card goes somewhere nobody can see
+type cardKnowledge struct {
+	KnownTo []string
+	ShownTo []string
+}
+
+// Start everyone off knowing nothing, apart from the cards they peek at before the game starts
+// a game restored from before cards had knowledge gets whatever's face up in the state it's in
+func (s *bungaGameState) initKnowledge() {
+	s.Knowledge = map[string][]cardKnowledge{Draw: make([]cardKnowledge, 1)}
+	for _, player := range s.PlayerOrder {
+		s.Knowledge[player] = make([]cardKnowledge, len(s.PlayerHands[player]))
+		if s.GameState != StartGame || s.PlayersReady[player] != "" {
+			continue
+		}
+		for i := 0; i < s.Rules.PeekCount && i < len(s.PlayerHands[player]); i++ {
+			s.show(player, i, player)
+		}
+	}
+	switch {
+	case s.GameState == EndGame:
+		s.revealAll()
+	case s.GameState != Playing:
+	case s.PlayingState == DrawChoice:
+		s.show(Draw, 0, s.Turn)
+	case s.SelectedOwner != "" && s.PlayingState != SwapOtherOwnChoice:
+		s.show(s.SelectedOwner, s.SelectedIdx, s.Turn)
+	}
+}
+
+// The knowledge of a card in a hand, or of the top of the draw pile with Draw as the owner
+func (s *bungaGameState) knowledge(owner string, idx int) cardKnowledge {
+	if idx < 0 || idx >= len(s.Knowledge[owner]) {
+		return cardKnowledge{}
+	}
+	return s.Knowledge[owner][idx]
+}
+
+func (s *bungaGameState) knows(player string, owner string, idx int) bool {
+	return containsId(s.knowledge(owner, idx).KnownTo, player)
+}
+
+func (s *bungaGameState) shownTo(player string, owner string, idx int) bool {
+	return containsId(s.knowledge(owner, idx).ShownTo, player)
+}
+
+// Whether a card is face up for every player, like every card once the game's over
+func (s *bungaGameState) shownToAll(owner string, idx int) bool {
+	for _, player := range s.PlayerOrder {
+		if !s.shownTo(player, owner, idx) {
+			return false
+		}
+	}
+	return true
+}
+
+// Turn a card face up for a player, who knows it from then on
+func (s *bungaGameState) show(owner string, idx int, player string) {
+	k := s.knowledge(owner, idx)
+	if !containsId(k.KnownTo, player) {
+		k.KnownTo = append(append([]string{}, k.KnownTo...), player)
+	}
+	if !containsId(k.ShownTo, player) {
+		k.ShownTo = append(append([]string{}, k.ShownTo...), player)
+	}
+	s.Knowledge[owner][idx] = k
+}
+
+// Turn every card that's face up for a player back down, they still know what they saw
+func (s *bungaGameState) hideFrom(player string) {
+	for owner, cards := range s.Knowledge {
+		for i, k := range cards {
+			if containsId(k.ShownTo, player) {
+				s.Knowledge[owner][i].ShownTo = removeId(append([]string{}, k.ShownTo...), player)
+			}
+		}
+	}
+}
+
+// Turn every card back down, at the end of a turn
+func (s *bungaGameState) hideAll() {
+	for owner, cards := range s.Knowledge {
+		for i := range cards {
+			s.Knowledge[owner][i].ShownTo = nil
+		}
+	}
+}
+
+// Turn every card in every hand face up for everyone, once the game's over
+func (s *bungaGameState) revealAll() {
+	for _, owner := range s.PlayerOrder {
+		for i := range s.Knowledge[owner] {
+			for _, player := range s.PlayerOrder {
+				s.show(owner, i, player)
+			}
+		}
+	}
+}
+
+// Nobody knows the card on top of the draw pile once the last one's been drawn
+func (s *bungaGameState) forgetDrawTop() {
+	s.Knowledge[Draw] = make([]cardKnowledge, 1)
+}
+
+// Add a card to the end of a hand, along with what's known about it
+func (s *bungaGameState) addCard(owner string, card string, k cardKnowledge) {
+	s.PlayerHands[owner] = append(s.PlayerHands[owner], card)
+	s.Knowledge[owner] = append(s.Knowledge[owner], k)
+}
+
+// Put a card in place of one in a hand, along with what's known about it
+func (s *bungaGameState) replaceCard(owner string, idx int, card string, k cardKnowledge) {
+	s.PlayerHands[owner][idx] = card
+	s.Knowledge[owner][idx] = k
+}
+
+// Take a card out of a hand, and everything known about it
+func (s *bungaGameState) takeCard(owner string, idx int) {
+	hand, known := s.PlayerHands[owner], s.Knowledge[owner]
+	s.PlayerHands[owner] = append(hand[:idx], hand[idx+1:]...)
+	s.Knowledge[owner] = append(known[:idx], known[idx+1:]...)
+}
+
+// Swap two cards between hands, along with what's known about them
+func (s *bungaGameState) swapCards(owner string, idx int, other string, otherIdx int) {
+	s.PlayerHands[owner][idx], s.PlayerHands[other][otherIdx] = s.PlayerHands[other][otherIdx], s.PlayerHands[owner][idx]
+	s.Knowledge[owner][idx], s.Knowledge[other][otherIdx] = s.Knowledge[other][otherIdx], s.Knowledge[owner][idx]
+}
+
+// Everyone knows a card that's come off the discard pile
+func (s *bungaGameState) publicKnowledge() cardKnowledge {
+	return cardKnowledge{KnownTo: append([]string{}, s.PlayerOrder...)}
+}
+
+// Every hand as a player sees it, with the cards that are face up for them and backs for the rest
+// Final gets the hands as everyone sees them, and anyone who isn't playing only sees backs
+// The backs of the bunga caller's cards are marked
+func (s *bungaGameState) handsFor(viewer string) map[string][]string {
+	ret := map[string][]string{}
+	for _, owner := range s.PlayerOrder {
+		hand := make([]string, len(s.PlayerHands[owner]))
+		known := s.Knowledge[owner]
+		for i, card := range s.PlayerHands[owner] {
+			if i < len(known) && containsId(known[i].ShownTo, viewer) || (viewer == Final && s.shownToAll(owner, i)) {
+				hand[i] = card
+			} else if s.SaidBunga == owner {
+				hand[i] = Back + BungHl
+			} else {
+				hand[i] = Back
+			}
+		}
+		ret[owner] = hand
+	}
+	return ret
+}
+
+// With assisted memory, every card a player knows that isn't face up for them, by where it is now
+// and "" for the cards they don't know, otherwise nil
+func (s *bungaGameState) rememberedBy(viewer string) map[string][]string {
+	if !s.Rules.AssistedMemory {
+		return nil
+	}
+	ret := map[string][]string{}
+	for _, owner := range s.PlayerOrder {
+		hand := make([]string, len(s.PlayerHands[owner]))
+		for i, card := range s.PlayerHands[owner] {
+			if s.knows(viewer, owner, i) && !s.shownTo(viewer, owner, i) {
+				hand[i] = card
+			}
+		}
+		ret[owner] = hand
+	}
+	return ret
+}
+
+func (k cardKnowledge) clone() cardKnowledge {
+	return cardKnowledge{
+		KnownTo: append([]string(nil), k.KnownTo...),
+		ShownTo: append([]string(nil), k.ShownTo...),
+	}
+}